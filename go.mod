@@ -1,9 +1,11 @@
 module github.com/gearsix/goldmark-mmd
 
-go 1.17
+go 1.18
 
 require (
 	github.com/yuin/goldmark v1.4.6
+	golang.org/x/text v0.3.2
+	gopkg.in/yaml.v3 v3.0.1
 	notabug.org/gearsix/dati v1.2.2
 )
 
@@ -94,12 +96,10 @@ require (
 	github.com/uudashr/gocognit v1.0.1 // indirect
 	golang.org/x/mod v0.3.0 // indirect
 	golang.org/x/sys v0.0.0-20200323222414-85ca7c5b95cd // indirect
-	golang.org/x/text v0.3.2 // indirect
 	golang.org/x/tools v0.0.0-20200702044944-0cc1aa72b347 // indirect
 	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543 // indirect
 	gopkg.in/ini.v1 v1.51.0 // indirect
 	gopkg.in/yaml.v2 v2.3.0 // indirect
-	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 	honnef.co/go/tools v0.0.1-2020.1.4 // indirect
 	mvdan.cc/gofumpt v0.0.0-20200513141252-abc0db2c416a // indirect
 	mvdan.cc/interfacer v0.0.0-20180901003855-c20040233aed // indirect
@@ -5,184 +5,3979 @@
 package meta
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/yuin/goldmark"
 	gast "github.com/yuin/goldmark/ast"
 	"github.com/yuin/goldmark/parser"
 	"github.com/yuin/goldmark/text"
 	"github.com/yuin/goldmark/util"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+	"gopkg.in/yaml.v3"
 	"notabug.org/gearsix/dati"
 )
 
 type metadata map[string]interface{}
 
 type data struct {
-	Map   metadata
-	Error error
-	Node  gast.Node
+	Map    metadata
+	Keys   []string
+	Order  *keyOrder
+	Error  error
+	Node   gast.Node
+	Source []byte
+	Config *parserConfig
+	Start  int
+	Stop   int
+	Spans  map[string][2]int
+	// set once the document is transformed, after which the data is stale
+	transformed bool
 }
 
 var contextKey = parser.NewContextKey()
 
+var blockKey = parser.NewContextKey()
+
+var prevBlockKey = parser.NewContextKey()
+
+// ErrNoMetadata is returned when a parser.Context has no metadata.
+var ErrNoMetadata = errors.New("meta: no metadata found")
+
+// ErrUnknownSignal is returned when a metadata block has a signal that isn't
+// supported, see WithReportUnknownSignal.
+var ErrUnknownSignal = errors.New("meta: unknown format signal")
+
+// ErrEmptyMetadata is returned when a metadata block has no keys, see
+// WithRejectEmpty.
+var ErrEmptyMetadata = errors.New("meta: metadata block is empty")
+
 // Get returns a metadata.
 func Get(pc parser.Context) metadata {
 	v := pc.Get(contextKey)
 	if v == nil {
 		return nil
 	}
-	d := v.(*data)
-	return d.Map
+	d := v.(*data)
+	return d.Map
+}
+
+// Present reports whether a metadata block was found, even if it was empty
+// or failed to parse. It's false for the error stored by WithMandatoryBlock
+// when there's no block.
+func Present(pc parser.Context) bool {
+	v := pc.Get(contextKey)
+	return v != nil && v.(*data).Node != nil
+}
+
+// GetCopy returns a deep copy of the metadata, so that changes to it don't
+// affect the metadata stored in `pc`.
+func GetCopy(pc parser.Context) metadata {
+	m := Get(pc)
+	if m == nil {
+		return nil
+	}
+	return deepCopy(m).(metadata)
+}
+
+// deepCopy returns a copy of `v`, recursing into maps and slices.
+func deepCopy(v interface{}) interface{} {
+	switch t := v.(type) {
+	case metadata:
+		m := make(metadata, len(t))
+		for k, e := range t {
+			m[k] = deepCopy(e)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = deepCopy(e)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{}, len(t))
+		for k, e := range t {
+			m[k] = deepCopy(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, e := range t {
+			s[i] = deepCopy(e)
+		}
+		return s
+	case []map[string]string:
+		s := make([]map[string]string, len(t))
+		for i, e := range t {
+			s[i] = make(map[string]string, len(e))
+			for k, f := range e {
+				s[i][k] = f
+			}
+		}
+		return s
+	}
+	return v
+}
+
+// TryGet tries to get a metadata.
+// If there are parsing errors, then nil and error are returned
+func TryGet(pc parser.Context) (metadata, error) {
+	dtmp := pc.Get(contextKey)
+	if dtmp == nil {
+		return nil, nil
+	}
+	d := dtmp.(*data)
+	if d.Error != nil {
+		return nil, d.Error
+	}
+	return d.Map, nil
+}
+
+// MustGet is like TryGet but panics if there is no metadata or if there
+// were parsing errors.
+func MustGet(pc parser.Context) metadata {
+	m, err := TryGet(pc)
+	if err != nil {
+		panic(err.Error())
+	} else if m == nil {
+		panic("meta: no metadata found in parser.Context")
+	}
+	return m
+}
+
+// rendererAttribute is the attribute of the ast.Document that the metadata
+// is stored in for renderers, see GetFromRenderer.
+var rendererAttribute = []byte("goldmark-mmd-meta")
+
+// GetFromRenderer returns the metadata of the document that `n` belongs to,
+// so that it can be read by a renderer.NodeRenderer while rendering.
+// If there is no metadata or `n` isn't part of a document, then nil is
+// returned.
+func GetFromRenderer(n gast.Node) metadata {
+	doc, ok := n.(*gast.Document)
+	if !ok && n.Parent() != nil {
+		doc = n.OwnerDocument()
+	}
+	if doc == nil {
+		return nil
+	}
+	v, _ := doc.Attribute(rendererAttribute)
+	m, _ := v.(metadata)
+	return m
+}
+
+// KeySpans returns the start and stop offsets in the source of each
+// top-level key of the metadata, from the start of its line to the end of
+// its value (excluding the final newline). Spans are only recorded for YAML
+// metadata parsed with WithKeySpans. If there are none, then nil is returned.
+func KeySpans(pc parser.Context) map[string][2]int {
+	d, ok := pc.Get(contextKey).(*data)
+	if !ok || d.Error != nil {
+		return nil
+	}
+	return d.Spans
+}
+
+// GetAny returns the value of the first of `keys` that's set in the
+// metadata. If none of them are, then nil and false are returned.
+func GetAny(pc parser.Context, keys ...string) (interface{}, bool) {
+	m := Get(pc)
+	for _, key := range keys {
+		if v, ok := m[key]; ok {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+// GetAs returns the value of `key` as a T. If `key` is missing or its value
+// isn't a T, then the zero value and false are returned.
+func GetAs[T any](pc parser.Context, key string) (T, bool) {
+	v, ok := Get(pc)[key].(T)
+	return v, ok
+}
+
+// GetBool returns the boolean value of `key`.
+// If the WithTruthyStrings option was used, the strings yes/no, on/off,
+// true/false and 1/0 (and the numbers 1/0) are also read as booleans.
+// If `key` is missing or isn't a boolean, then false and false are returned.
+func GetBool(pc parser.Context, key string) (value bool, ok bool) {
+	v := pc.Get(contextKey)
+	if v == nil {
+		return false, false
+	}
+	d := v.(*data)
+	switch t := d.Map[key].(type) {
+	case bool:
+		return t, true
+	case string:
+		if d.Config != nil && d.Config.TruthyStrings {
+			switch strings.ToLower(strings.TrimSpace(t)) {
+			case "yes", "on", "true", "1":
+				return true, true
+			case "no", "off", "false", "0":
+				return false, true
+			}
+		}
+	case int, int64, float64:
+		if d.Config != nil && d.Config.TruthyStrings {
+			switch fmt.Sprint(t) {
+			case "1":
+				return true, true
+			case "0":
+				return false, true
+			}
+		}
+	}
+	return false, false
+}
+
+// GetDuration returns the value of `key` as a time.Duration, read from a
+// duration string (see time.ParseDuration) or a number of seconds.
+// If `key` is missing or can't be read as a duration, then 0 and false are
+// returned.
+func GetDuration(pc parser.Context, key string) (time.Duration, bool) {
+	switch t := Get(pc)[key].(type) {
+	case string:
+		if d, err := time.ParseDuration(strings.TrimSpace(t)); err == nil {
+			return d, true
+		}
+	case int:
+		return time.Duration(t) * time.Second, true
+	case int64:
+		return time.Duration(t) * time.Second, true
+	case uint64:
+		return time.Duration(t) * time.Second, true
+	case float64:
+		return time.Duration(t * float64(time.Second)), true
+	}
+	return 0, false
+}
+
+// GetLocalized returns the value for `lang` in the map stored under `key`
+// (e.g. `title: {en: ..., fr: ...}`), falling back to the language set with
+// WithDefaultLang. If neither language is found, then nil and false are
+// returned.
+func GetLocalized(pc parser.Context, key, lang string) (interface{}, bool) {
+	v := pc.Get(contextKey)
+	if v == nil {
+		return nil, false
+	}
+	d := v.(*data)
+	langs := []string{lang}
+	if d.Config != nil && d.Config.DefaultLang != "" {
+		langs = append(langs, d.Config.DefaultLang)
+	}
+	t, _ := normalize(d.Map[key]).(map[string]interface{})
+	for _, l := range langs {
+		if value, ok := t[l]; ok {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// GetStringMap returns the value of `key` as a map of strings.
+// If `key` is missing, isn't a map or has a value that isn't a string, then
+// nil and false are returned.
+func GetStringMap(pc parser.Context, key string) (map[string]string, bool) {
+	t, ok := normalize(Get(pc)[key]).(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	m := make(map[string]string, len(t))
+	for k, v := range t {
+		s, ok := v.(string)
+		if !ok {
+			return nil, false
+		}
+		m[k] = s
+	}
+	return m, true
+}
+
+// GetCSVSlice returns the value of `key` as a slice of strings, whether it's
+// a list of strings or a comma-separated string (e.g. "markdown, goldmark"),
+// which is split and trimmed, skipping empty items.
+// If `key` is missing or isn't either, then nil and false are returned.
+func GetCSVSlice(pc parser.Context, key string) ([]string, bool) {
+	switch t := Get(pc)[key].(type) {
+	case []interface{}:
+		s := make([]string, 0, len(t))
+		for _, e := range t {
+			str, ok := e.(string)
+			if !ok {
+				return nil, false
+			}
+			s = append(s, str)
+		}
+		return s, true
+	case string:
+		s := []string{}
+		for _, item := range strings.Split(t, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				s = append(s, item)
+			}
+		}
+		return s, true
+	}
+	return nil, false
+}
+
+// GetURLValues returns the top-level keys of the metadata as url.Values,
+// with lists added as multiple values. Maps, and maps within lists, are
+// skipped. If there is no metadata, then empty url.Values are returned.
+func GetURLValues(pc parser.Context) url.Values {
+	values := url.Values{}
+	str := func(v interface{}) string {
+		if v == nil {
+			return ""
+		}
+		return fmt.Sprint(v)
+	}
+	m, _ := normalize(Get(pc)).(map[string]interface{})
+	for k, v := range m {
+		switch t := v.(type) {
+		case map[string]interface{}:
+		case []interface{}:
+			for _, e := range t {
+				switch e.(type) {
+				case map[string]interface{}, []interface{}:
+				default:
+					values.Add(k, str(e))
+				}
+			}
+		default:
+			values.Set(k, str(v))
+		}
+	}
+	return values
+}
+
+// GetFlat returns the metadata flattened into a single map, with the values
+// in nested maps and lists keyed by their dotted path (e.g. "Author.Name",
+// "Tags.0"). Empty maps and lists are kept as values.
+// If there is no metadata, then nil is returned.
+func GetFlat(pc parser.Context) map[string]interface{} {
+	m := Get(pc)
+	if m == nil {
+		return nil
+	}
+	flat := make(map[string]interface{})
+	for k, v := range normalize(m).(map[string]interface{}) {
+		flatten(flat, k, v)
+	}
+	return flat
+}
+
+// flatten sets the leaves of `v` in `flat`, keyed by their path from `key`.
+func flatten(flat map[string]interface{}, key string, v interface{}) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		if len(t) == 0 {
+			flat[key] = t
+		}
+		for k, e := range t {
+			flatten(flat, key+"."+k, e)
+		}
+	case []interface{}:
+		if len(t) == 0 {
+			flat[key] = t
+		}
+		for i, e := range t {
+			flatten(flat, key+"."+strconv.Itoa(i), e)
+		}
+	default:
+		flat[key] = v
+	}
+}
+
+// GetBytes returns the base64-encoded string value of `key`, decoded.
+// If `key` is missing or isn't valid base64, then nil and false are returned.
+func GetBytes(pc parser.Context, key string) ([]byte, bool) {
+	s, ok := Get(pc)[key].(string)
+	if !ok {
+		return nil, false
+	}
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, false
+	}
+	return buf, true
+}
+
+// GetSpan returns the byte offsets of the metadata block in the source,
+// from the start of its open token to the end of its close token.
+// If there is no metadata, then ok is false.
+func GetSpan(pc parser.Context) (start, stop int, ok bool) {
+	d, ok := pc.Get(contextKey).(*data)
+	if !ok || d.Node == nil {
+		return 0, 0, false
+	}
+	return d.Start, d.Stop, true
+}
+
+// BodyLineOffset returns the number of source lines taken up by the
+// metadata block, including its open and close tokens, so that line numbers
+// in the rendered body can be mapped back to the source.
+// If there is no metadata, then 0 is returned.
+func BodyLineOffset(pc parser.Context) int {
+	d, ok := pc.Get(contextKey).(*data)
+	if !ok || d.Node == nil {
+		return 0
+	}
+	return bytes.Count(d.Source[d.Start:d.Stop], []byte("\n")) + 1
+}
+
+// Range calls `fn` for each top-level key and value of the metadata in
+// sorted key order, stopping if `fn` returns false.
+// If there is no metadata, then `fn` isn't called.
+func Range(pc parser.Context, fn func(key string, value interface{}) bool) {
+	m := Get(pc)
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !fn(k, m[k]) {
+			return
+		}
+	}
+}
+
+// GetList returns the metadata of a top-level JSON array (`<!--[...]-->`).
+// If the metadata isn't a list, then nil and false are returned.
+func GetList(pc parser.Context) ([]interface{}, bool) {
+	list, ok := Get(pc)[jsonListKey].([]interface{})
+	return list, ok
+}
+
+// Parse returns the metadata of the block at the start of `source`, without
+// converting it. If there is no metadata block, then nil and nil are
+// returned.
+func Parse(source []byte) (metadata, error) {
+	d := parseSource(source)
+	if d == nil {
+		return nil, nil
+	} else if d.Error != nil {
+		return nil, d.Error
+	}
+	return d.Map, nil
+}
+
+// ExtractMeta is like Parse, but also returns the rest of `source` after the
+// metadata block, without its first newline. If there is no metadata block,
+// then `source` is returned as the body.
+func ExtractMeta(source []byte) (meta metadata, body []byte, err error) {
+	d := parseSource(source)
+	if d == nil {
+		return nil, source, nil
+	}
+	body = source[d.Stop:]
+	if bytes.HasPrefix(body, []byte("\r\n")) {
+		body = body[2:]
+	} else if bytes.HasPrefix(body, []byte("\n")) {
+		body = body[1:]
+	}
+	if d.Error != nil {
+		return nil, body, d.Error
+	}
+	return d.Map, body, nil
+}
+
+// Diff returns descriptions of the top-level keys added, removed and changed
+// from `a` to `b`, sorted by key. Keys of maps nested in both are compared
+// too, and named by their path (e.g. "Author.Name").
+func Diff(a, b metadata) []string {
+	am, _ := normalize(a).(map[string]interface{})
+	bm, _ := normalize(b).(map[string]interface{})
+	return diffMaps("", am, bm, true)
+}
+
+func diffMaps(prefix string, a, b map[string]interface{}, recurse bool) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var diff []string
+	for _, k := range keys {
+		av, inA := a[k]
+		bv, inB := b[k]
+		switch {
+		case !inA:
+			diff = append(diff, fmt.Sprintf("added %s%s: %v", prefix, k, bv))
+		case !inB:
+			diff = append(diff, fmt.Sprintf("removed %s%s: %v", prefix, k, av))
+		case !reflect.DeepEqual(av, bv):
+			anested, aok := av.(map[string]interface{})
+			bnested, bok := bv.(map[string]interface{})
+			if recurse && aok && bok {
+				diff = append(diff, diffMaps(prefix+k+".", anested, bnested, false)...)
+			} else {
+				diff = append(diff, fmt.Sprintf("changed %s%s: %v -> %v", prefix, k, av, bv))
+			}
+		}
+	}
+	return diff
+}
+
+// parseSource decodes the metadata block at the start of `source`.
+// If there is no metadata block, then nil is returned.
+func parseSource(source []byte) *data {
+	b := newParser()
+	line := source
+	if i := bytes.IndexByte(source, '\n'); i != -1 {
+		line = source[:i+1]
+	}
+	if !b.isOpen(line) {
+		return nil
+	}
+
+	b.start = bytes.Index(source, []byte(b.OpenToken))
+	b.stop = b.start + len(b.OpenToken)
+	b.stop += b.setFormat(source[b.stop:])
+	var buf bytes.Buffer
+	for b.stop < len(source) {
+		rest := source[b.stop:]
+		end := bytes.IndexByte(rest, '\n') + 1
+		if end == 0 {
+			end = len(rest)
+		}
+		line = rest[:end]
+		if n := b.isClose(line); n != -1 && !util.IsBlank(line) {
+			buf.Write(line[:n])
+			b.stop += b.closeEnd(line, n)
+			b.closed = true
+			break
+		}
+		b.track(line)
+		buf.Write(line)
+		b.stop += end
+	}
+
+	d := &data{Source: source, Config: b.parserConfig, Start: b.start, Stop: b.stop}
+	b.decode(d, buf.Bytes())
+	return d
+}
+
+// maxReaderBlockSize is the most ParseReader will read.
+const maxReaderBlockSize = 1 << 20
+
+// ParseReader is like Parse, but reads the metadata block from `r`, leaving
+// `r` positioned after its close token so the rest can be read from it.
+// An error is returned if the block exceeds 1MiB. If `r` doesn't start with
+// a metadata block, then nothing is read from it.
+func ParseReader(r *bufio.Reader) (metadata, error) {
+	b := newParser()
+	src, err := r.Peek(len(b.OpenToken) + 1)
+	if err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	} else if !b.isOpen(src) {
+		return nil, nil
+	}
+	src = append([]byte(nil), src...)
+	r.Discard(len(src))
+
+	start := len(src) - b.setFormat(src[len(b.OpenToken):])
+	for {
+		if len(src) > maxReaderBlockSize {
+			return nil, fmt.Errorf("meta: metadata block exceeds %d bytes", maxReaderBlockSize)
+		}
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		src = append(src, c)
+		line := src[start:]
+		if c == '\n' {
+			b.track(line)
+			start = len(src)
+		} else if b.closeToken(line, bytes.HasSuffix) != "" {
+			if n := b.isClose(line); n != -1 && b.closeEnd(line, n) == len(line) {
+				break
+			}
+		}
+	}
+	return Parse(src)
+}
+
+// ConvertWithMeta converts `source` using `md` and writes the result to `w`,
+// returning the metadata parsed from it. Any metadata parsing error is
+// returned after the conversion.
+func ConvertWithMeta(md goldmark.Markdown, source []byte, w io.Writer) (metadata, error) {
+	pc := parser.NewContext()
+	if err := md.Convert(source, w, parser.WithContext(pc)); err != nil {
+		return nil, err
+	}
+	return TryGet(pc)
+}
+
+// DecodeSource returns `source` transcoded to UTF-8 from `enc`, to be called
+// on a document before converting it, since goldmark only parses UTF-8.
+// If `enc` is nil, the encoding is detected from a UTF-8 or UTF-16 byte
+// order mark at the start of `source` and `source` is returned as-is when
+// there isn't one.
+func DecodeSource(source []byte, enc encoding.Encoding) ([]byte, error) {
+	if enc == nil {
+		switch {
+		case bytes.HasPrefix(source, []byte{0xEF, 0xBB, 0xBF}):
+			return source[3:], nil
+		case bytes.HasPrefix(source, []byte{0xFF, 0xFE}):
+			enc = unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM)
+		case bytes.HasPrefix(source, []byte{0xFE, 0xFF}):
+			enc = unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM)
+		default:
+			return source, nil
+		}
+	}
+	return enc.NewDecoder().Bytes(source)
+}
+
+// Clear removes any metadata stored in `pc`, including under the keys set
+// with WithCompatKeys.
+//
+// Metadata left in a reused parser.Context by a previous document is also
+// dropped when the next document is parsed, so Clear is only needed when the
+// context is read before that.
+func Clear(pc parser.Context) {
+	if d, ok := pc.Get(contextKey).(*data); ok && d.Config != nil {
+		for _, key := range d.Config.CompatKeys {
+			pc.Set(key, nil)
+		}
+	}
+	pc.Set(contextKey, nil)
+}
+
+// OrderedKeys returns the top-level metadata keys in the order they appear
+// in the source. Keys are only recorded when the WithOrderedKeys option is
+// used, otherwise nil is returned.
+func OrderedKeys(pc parser.Context) []string {
+	v := pc.Get(contextKey)
+	if v == nil {
+		return nil
+	}
+	d := v.(*data)
+	return d.Keys
+}
+
+// KV is a key and value of the metadata.
+type KV struct {
+	Key   string
+	Value interface{}
+}
+
+// MapSlice is a map of metadata in the order its keys appear in the source.
+// It's encoded as a map by yaml.Marshal, keeping that order.
+type MapSlice []KV
+
+// MarshalYAML returns `s` as a YAML mapping node in the order of its keys.
+func (s MapSlice) MarshalYAML() (interface{}, error) {
+	n := &yaml.Node{Kind: yaml.MappingNode}
+	for _, kv := range s {
+		var k, v yaml.Node
+		if err := k.Encode(kv.Key); err != nil {
+			return nil, err
+		} else if err = v.Encode(kv.Value); err != nil {
+			return nil, err
+		}
+		n.Content = append(n.Content, &k, &v)
+	}
+	return n, nil
+}
+
+// GetOrdered returns the top-level keys and values of the metadata in the
+// order they appear in the source, with their original casing. The order is
+// only recorded when the WithYAMLMapSlice or WithOrderedKeys options are
+// used, otherwise nil is returned. With WithYAMLMapSlice, maps nested in
+// the values are returned as a MapSlice in their source order too.
+func GetOrdered(pc parser.Context) MapSlice {
+	v := pc.Get(contextKey)
+	if v == nil {
+		return nil
+	}
+	d := v.(*data)
+	if d.Keys == nil {
+		return nil
+	}
+	kvs := make(MapSlice, 0, len(d.Keys))
+	for _, k := range d.Keys {
+		value := d.Map[k]
+		if d.Order != nil {
+			value = d.Order.sub[k].apply(value)
+		}
+		kvs = append(kvs, KV{Key: k, Value: value})
+	}
+	return kvs
+}
+
+// MarshalJSON returns the metadata encoded as JSON.
+// If there are parsing errors, then nil and the error are returned; if there
+// is no metadata, then ErrNoMetadata is returned.
+func MarshalJSON(pc parser.Context) ([]byte, error) {
+	m, err := TryGet(pc)
+	if err != nil {
+		return nil, err
+	} else if m == nil {
+		return nil, ErrNoMetadata
+	}
+	return json.Marshal(normalize(m))
+}
+
+// RenderMeta writes the metadata to `w`, encoded as `format` (yaml, toml or
+// json). If there are parsing errors, then the error is returned; if there
+// is no metadata, then ErrNoMetadata is returned.
+func RenderMeta(pc parser.Context, format string, w io.Writer) error {
+	m, err := TryGet(pc)
+	if err != nil {
+		return err
+	} else if m == nil {
+		return ErrNoMetadata
+	}
+	var f dati.DataFormat
+	switch strings.ToLower(format) {
+	case "yaml", "yml":
+		f = dati.YAML
+	case "toml":
+		f = dati.TOML
+	case "json":
+		f = dati.JSON
+	default:
+		return fmt.Errorf("meta: %w", dati.ErrUnsupportedData(format))
+	}
+	return dati.WriteData(f, normalize(m), w)
+}
+
+// normalize returns `v` with any maps converted to map[string]interface{},
+// so that YAML maps with non-string keys can be encoded as JSON.
+func normalize(v interface{}) interface{} {
+	switch t := v.(type) {
+	case metadata:
+		return normalize(map[string]interface{}(t))
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[k] = normalize(e)
+		}
+		return m
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, e := range t {
+			m[fmt.Sprint(k)] = normalize(e)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for i, e := range t {
+			s[i] = normalize(e)
+		}
+		return s
+	}
+	return v
+}
+
+const openToken = "<!--"
+const closeToken = "-->"
+const formatYaml = ':'
+const formatToml = '#'
+const formatJsonOpen = '{'
+const formatJsonClose = '}'
+const formatJsonListOpen = '['
+const formatJsonListClose = ']'
+const formatCsv = ','
+
+// formatAuto is the format of blocks opened without a signal when the
+// WithAutoDetect option is used.
+const formatAuto = 0
+
+// csvRowsKey is the key CSV rows are stored under.
+const csvRowsKey = "_rows"
+
+// jsonListKey is the key a top-level JSON array is stored under.
+const jsonListKey = "_list"
+
+// fileReferencePrefix prefixes string values referencing a file, see
+// WithFileReferences.
+const fileReferencePrefix = "@file:"
+
+// formatNames maps the names accepted by WithNamedFormats to their format.
+var formatNames = map[string]byte{
+	"yaml": formatYaml,
+	"yml":  formatYaml,
+	"toml": formatToml,
+	"json": formatJsonClose,
+	"csv":  formatCsv,
+}
+
+// closeSignal returns the signal closing a block opened with `signal`.
+func closeSignal(signal byte) byte {
+	switch signal {
+	case formatJsonOpen:
+		return formatJsonClose
+	case formatJsonListOpen:
+		return formatJsonListClose
+	}
+	return signal
+}
+
+// openSignal returns the signal opening a block closed with `signal`.
+func openSignal(signal byte) byte {
+	switch signal {
+	case formatJsonClose:
+		return formatJsonOpen
+	case formatJsonListClose:
+		return formatJsonListOpen
+	}
+	return signal
+}
+
+// isJson reports whether `format` is JSON, where the signals are part of
+// the metadata.
+func isJson(format byte) bool {
+	return format == formatJsonClose || format == formatJsonListClose
+}
+
+type metaParser struct {
+	*parserConfig
+	format byte
+	named  string
+	closed bool
+	brace  bool
+	size   int
+	large  bool
+	start  int
+	stop   int
+	// the block has a guard, which didn't match if unmatched is set
+	guarded   bool
+	unmatched bool
+	// source of the document and node of the block
+	source []byte
+	node   gast.Node
+}
+
+type parserConfig struct {
+	// Token opening a metadata block, followed by the format signal.
+	OpenToken string
+	// Token closing a metadata block, preceded by the format signal.
+	CloseToken string
+	// Expands $VAR and ${VAR} in string values using this mapping.
+	EnvLookup func(string) string
+	// Decoders to use in place of dati, keyed by their opening signal.
+	Decoders map[byte]func([]byte, interface{}) error
+	// Records the source order of top-level keys.
+	OrderedKeys bool
+	// Also accepts a metadata block at the end of the document.
+	TrailingBlock bool
+	// Renames top-level keys, mapping aliases to canonical keys.
+	KeyAliases map[string]string
+	// Validates parsed metadata, an error is stored as the parse error.
+	Validators []func(metadata) error
+	// Allows a metadata block to interrupt a paragraph.
+	InterruptParagraph bool
+	// Closes a metadata block missing its close token at the end of the document.
+	ImplicitClose bool
+	// Reads common truthy/falsy strings as booleans in GetBool.
+	TruthyStrings bool
+	// Keeps the decodable subset of YAML metadata that fails to decode.
+	BestEffort bool
+	// Schema, in a subset of JSON Schema, to validate parsed metadata against.
+	Schema interface{}
+	// Error from parsing Schema.
+	SchemaError error
+	// Leaves the metadata block in the output as an HTML comment.
+	PreserveComment bool
+	// Replaces ${Key} in top-level string values with the value of Key.
+	InterpolateKeys bool
+	// Language GetLocalized falls back to.
+	DefaultLang string
+	// Also accepts format names (e.g. "yaml") in place of signals.
+	NamedFormats bool
+	// Accepts blocks without a signal, detecting their format.
+	AutoDetect bool
+	// Stops reading a metadata block once it exceeds this many bytes.
+	MaxBlockSize int
+	// Metadata that parsed metadata is merged on top of.
+	BaseMetadata metadata
+	// Replaces "@file:" string values with the file's contents from this FS.
+	FileReferences fs.FS
+	// Rejects JSON metadata with duplicate keys.
+	StrictJSON bool
+	// Converts date and datetime strings to time.Time.
+	NormalizeDates bool
+	// Location zoneless dates are read in by NormalizeDates, UTC if nil.
+	Location *time.Location
+	// Also accepts the close token without the signal before it.
+	UniformClose bool
+	// Context keys parsed metadata is also stored under.
+	CompatKeys []parser.ContextKey
+	// Top-level keys allowed in metadata, others are a parsing error.
+	AllowedKeys map[string]bool
+	// Skips the first line of the document if it starts with this prefix.
+	SkipFirstLineIf string
+	// Receives warnings about metadata that isn't an error.
+	WarningHandler func(string)
+	// Converts the values of top-level keys to these types.
+	Types map[string]string
+	// Token that also closes a metadata block, preceded by the format signal.
+	AltCloseToken string
+	// Most levels of maps and lists metadata can be nested in.
+	MaxDepth int
+	// Struct type YAML metadata must only have the fields of.
+	YAMLKnownFields reflect.Type
+	// Stores decoded metadata by a hash of its block.
+	Cache Cache
+	// Variables the guards of metadata blocks are matched against.
+	BuildVars map[string]string
+	// Also closes YAML metadata blocks at a "---" line.
+	LenientClose bool
+	// Formats accepted by signal or name, keyed by their close signal.
+	Formats map[byte]bool
+	// Most nodes YAML aliases can expand to.
+	MaxAliasExpansion int
+	// Called with the final metadata of each block parsed without error.
+	OnParsed func(metadata)
+	// Allows comments and trailing commas in JSON metadata.
+	LenientJSON bool
+	// Records the source span of each top-level key in YAML metadata.
+	KeySpans bool
+	// Records the order of top-level keys in YAML metadata.
+	YAMLMapSlice bool
+	// Derives the Slug key from the metadata when it isn't set.
+	DeriveSlug func(metadata) string
+	// Key of the submap merged over the top-level keys.
+	Environment string
+	// Keys of environment submaps removed after merging.
+	Environments []string
+	// Treats a comment opening with an unknown signal as a parsing error.
+	ReportUnknownSignal bool
+	// Raw HTML the metadata block is replaced with in the output.
+	Placeholder string
+	// Merges consecutive metadata blocks at the start of the document.
+	MultipleBlocks bool
+	// Treats a metadata block without any keys as a parsing error.
+	RejectEmpty bool
+	// Rewrites top-level keys to a naming convention.
+	KeyStyle func(string) string
+	// Error from an unknown key style.
+	KeyStyleError error
+	// Values allowed for top-level keys.
+	Enums map[string][]string
+}
+
+type parserOption interface {
+	Option
+
+	// SetParserOption sets options for the metadata parser.
+	SetParserOption(*parserConfig)
+}
+
+var defaultParser = newParser()
+
+// NewParser returns a BlockParser that can parse metadata blocks, configured
+// with the parser options in `opts`, so that it can be registered without
+// the rest of the extension. Options for the extension's ASTTransformer,
+// such as WithStoresInDocument, are ignored.
+func NewParser(opts ...Option) parser.BlockParser {
+	if len(opts) == 0 {
+		return defaultParser
+	}
+	popts := []parserOption{}
+	for _, opt := range opts {
+		if popt, ok := opt.(parserOption); ok {
+			popts = append(popts, popt)
+		}
+	}
+	return newParser(popts...)
+}
+
+func newParser(opts ...parserOption) *metaParser {
+	p := &metaParser{
+		parserConfig: &parserConfig{
+			OpenToken:          openToken,
+			CloseToken:         closeToken,
+			InterruptParagraph: true,
+		},
+	}
+	for _, o := range opts {
+		o.SetParserOption(p.parserConfig)
+	}
+	return p
+}
+
+var _ parserOption = &withTokens{}
+
+type withTokens struct {
+	open  string
+	close string
+}
+
+// WithTokens is a functional option that replaces the `<!--` and `-->`
+// tokens wrapping a metadata block with `open` and `close`.
+// Empty tokens are ignored, use NewWithError to have them reported.
+func WithTokens(open, close string) Option {
+	return &withTokens{
+		open:  open,
+		close: close,
+	}
+}
+
+func (o *withTokens) metaOption() {}
+
+func (o *withTokens) SetParserOption(c *parserConfig) {
+	if len(o.open) > 0 {
+		c.OpenToken = o.open
+	}
+	if len(o.close) > 0 {
+		c.CloseToken = o.close
+	}
+}
+
+var _ parserOption = &withEnvLookup{}
+
+type withEnvLookup struct {
+	value func(string) string
+}
+
+// WithEnvExpansion is a functional option that expands $VAR and ${VAR}
+// references in string metadata values from the environment.
+// Unset variables expand to an empty string.
+func WithEnvExpansion() Option {
+	return &withEnvLookup{
+		value: os.Getenv,
+	}
+}
+
+// WithEnvLookup is like WithEnvExpansion, but variables are looked up with
+// `fn` instead of the environment.
+func WithEnvLookup(fn func(string) string) Option {
+	return &withEnvLookup{
+		value: fn,
+	}
+}
+
+func (o *withEnvLookup) metaOption() {}
+
+func (o *withEnvLookup) SetParserOption(c *parserConfig) {
+	c.EnvLookup = o.value
+}
+
+var _ parserOption = &withOrderedKeys{}
+
+type withOrderedKeys struct {
+	value bool
+}
+
+// WithOrderedKeys is a functional option that records the order top-level
+// keys appear in the source, see OrderedKeys.
+// The order is scanned from the raw block for YAML, TOML and JSON; keys in
+// blocks decoded by WithDecoder are recorded in sorted order.
+func WithOrderedKeys() Option {
+	return &withOrderedKeys{
+		value: true,
+	}
+}
+
+func (o *withOrderedKeys) metaOption() {}
+
+func (o *withOrderedKeys) SetParserOption(c *parserConfig) {
+	c.OrderedKeys = o.value
+}
+
+var _ parserOption = &withTrailingBlock{}
+
+type withTrailingBlock struct {
+	value bool
+}
+
+// WithTrailingBlock is a functional option that also parses a metadata block
+// at the end of the document ("back matter"). The block must open at the
+// start of a line and only be followed by blank lines.
+// If a document has both a leading and a trailing block, the metadata from
+// the trailing block replaces the leading block's.
+func WithTrailingBlock() Option {
+	return &withTrailingBlock{
+		value: true,
+	}
+}
+
+func (o *withTrailingBlock) metaOption() {}
+
+func (o *withTrailingBlock) SetParserOption(c *parserConfig) {
+	c.TrailingBlock = o.value
+}
+
+var _ parserOption = &withKeyAliases{}
+
+type withKeyAliases struct {
+	value map[string]string
+}
+
+// WithKeyAliases is a functional option that renames top-level keys found in
+// `aliases` (mapping alias to canonical key) after parsing.
+// If both an alias and its canonical key are present, the canonical key is
+// kept and the alias dropped.
+func WithKeyAliases(aliases map[string]string) Option {
+	return &withKeyAliases{
+		value: aliases,
+	}
+}
+
+func (o *withKeyAliases) metaOption() {}
+
+func (o *withKeyAliases) SetParserOption(c *parserConfig) {
+	c.KeyAliases = o.value
+}
+
+var _ parserOption = &withValidator{}
+
+type withValidator struct {
+	value func(metadata) error
+}
+
+// WithValidator is a functional option that calls `fn` with the parsed
+// metadata. If `fn` returns an error, it's treated as a parsing error.
+// Multiple validators are called in the order they're given.
+func WithValidator(fn func(metadata) error) Option {
+	return &withValidator{
+		value: fn,
+	}
+}
+
+func (o *withValidator) metaOption() {}
+
+func (o *withValidator) SetParserOption(c *parserConfig) {
+	c.Validators = append(c.Validators, o.value)
+}
+
+var _ parserOption = &withInterruptParagraph{}
+
+type withInterruptParagraph struct {
+	value bool
+}
+
+// WithInterruptParagraph is a functional option that sets whether a metadata
+// block can interrupt a paragraph, e.g. a trailing block on the line after
+// the last paragraph. Defaults to true.
+func WithInterruptParagraph(value bool) Option {
+	return &withInterruptParagraph{
+		value: value,
+	}
+}
+
+func (o *withInterruptParagraph) metaOption() {}
+
+func (o *withInterruptParagraph) SetParserOption(c *parserConfig) {
+	c.InterruptParagraph = o.value
+}
+
+var _ parserOption = &withImplicitClose{}
+
+type withImplicitClose struct {
+	value bool
+}
+
+// WithImplicitClose is a functional option that makes the close token
+// optional for a metadata block that runs to the end of the document.
+// Without it, such a block is treated as a parsing error.
+func WithImplicitClose() Option {
+	return &withImplicitClose{
+		value: true,
+	}
+}
+
+func (o *withImplicitClose) metaOption() {}
+
+func (o *withImplicitClose) SetParserOption(c *parserConfig) {
+	c.ImplicitClose = o.value
+}
+
+var _ parserOption = &withTruthyStrings{}
+
+type withTruthyStrings struct {
+	value bool
+}
+
+// WithTruthyStrings is a functional option that makes GetBool read strings
+// like "yes" and "off" as booleans. The stored metadata is left unchanged.
+func WithTruthyStrings() Option {
+	return &withTruthyStrings{
+		value: true,
+	}
+}
+
+func (o *withTruthyStrings) metaOption() {}
+
+func (o *withTruthyStrings) SetParserOption(c *parserConfig) {
+	c.TruthyStrings = o.value
+}
+
+var _ parserOption = &withBestEffort{}
+
+type withBestEffort struct {
+	value bool
+}
+
+// WithBestEffort is a functional option that, when YAML metadata fails to
+// decode, decodes each top-level key separately and keeps those that succeed.
+// The parsing error is still returned by TryGet.
+func WithBestEffort() Option {
+	return &withBestEffort{
+		value: true,
+	}
+}
+
+func (o *withBestEffort) metaOption() {}
+
+func (o *withBestEffort) SetParserOption(c *parserConfig) {
+	c.BestEffort = o.value
+}
+
+var _ parserOption = &withSchema{}
+
+type withSchema struct {
+	value []byte
+}
+
+// WithSchema is a functional option that validates parsed metadata against
+// `schema`, treating a mismatch as a parsing error. `schema` is written in a
+// subset of JSON Schema, this isn't a full JSON Schema validator: only the
+// type, enum, required, properties, additionalProperties, items, pattern,
+// minimum, maximum, minLength, maxLength, minItems and maxItems keywords are
+// supported, along with annotations such as title and description. A schema
+// using any other keyword (e.g. $ref, anyOf or format) is treated as invalid,
+// rather than being partially applied. Use WithValidator with a JSON Schema
+// library to validate against a full JSON Schema.
+func WithSchema(schema []byte) Option {
+	return &withSchema{
+		value: schema,
+	}
+}
+
+func (o *withSchema) metaOption() {}
+
+func (o *withSchema) SetParserOption(c *parserConfig) {
+	c.Schema = nil
+	if c.SchemaError = json.Unmarshal(o.value, &c.Schema); c.SchemaError == nil {
+		c.SchemaError = checkSchema(c.Schema, "")
+	}
+}
+
+// schemaKeywords are the JSON Schema keywords supported by WithSchema:
+// true for those that validate and false for annotations, which are ignored.
+var schemaKeywords = map[string]bool{
+	"type": true, "enum": true, "required": true, "properties": true,
+	"additionalProperties": true, "items": true, "pattern": true,
+	"minimum": true, "maximum": true, "minLength": true, "maxLength": true,
+	"minItems": true, "maxItems": true,
+	"$schema": false, "$id": false, "$comment": false, "title": false,
+	"description": false, "default": false, "examples": false,
+	"deprecated": false, "readOnly": false, "writeOnly": false,
+}
+
+// checkSchema returns an error if `schema` at `path` uses a
+// keyword that validateSchema doesn't support.
+func checkSchema(schema interface{}, path string) error {
+	at := path
+	if at == "" {
+		at = "/"
+	}
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		if _, ok = schema.(bool); ok && path != "" {
+			return nil
+		}
+		return fmt.Errorf("%s: schema must be an object", at)
+	}
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, ok := schemaKeywords[k]; !ok {
+			return fmt.Errorf("%s: unsupported keyword %q", at, k)
+		}
+	}
+	properties, _ := s["properties"].(map[string]interface{})
+	for _, k := range keys {
+		if k == "additionalProperties" || k == "items" {
+			if err := checkSchema(s[k], path+"/"+k); err != nil {
+				return err
+			}
+		}
+	}
+	keys = keys[:0]
+	for k := range properties {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := checkSchema(properties[k], path+"/properties/"+k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var _ parserOption = &withDecoder{}
+
+type withDecoder struct {
+	signal byte
+	fn     func([]byte, interface{}) error
+}
+
+// WithDecoder is a functional option that decodes metadata blocks opened
+// with `signal` using `fn` instead of the default decoder for that format.
+// Signals that aren't otherwise supported are closed with the same signal.
+func WithDecoder(signal byte, fn func([]byte, interface{}) error) Option {
+	return &withDecoder{
+		signal: signal,
+		fn:     fn,
+	}
+}
+
+func (o *withDecoder) metaOption() {}
+
+func (o *withDecoder) SetParserOption(c *parserConfig) {
+	if c.Decoders == nil {
+		c.Decoders = make(map[byte]func([]byte, interface{}) error)
+	}
+	c.Decoders[o.signal] = o.fn
+}
+
+var _ parserOption = &withPreserveComment{}
+
+type withPreserveComment struct {
+	value bool
+}
+
+// WithPreserveComment is a functional option that renders successfully
+// parsed metadata blocks verbatim as HTML comments, instead of removing them.
+func WithPreserveComment() Option {
+	return &withPreserveComment{
+		value: true,
+	}
+}
+
+func (o *withPreserveComment) metaOption() {}
+
+func (o *withPreserveComment) SetParserOption(c *parserConfig) {
+	c.PreserveComment = o.value
+}
+
+var _ parserOption = &withInterpolateKeys{}
+
+type withInterpolateKeys struct {
+	value bool
+}
+
+// WithInterpolateKeys is a functional option that replaces ${Key} in
+// top-level string values with the top-level string value of Key.
+// Circular references are treated as a parsing error.
+func WithInterpolateKeys() Option {
+	return &withInterpolateKeys{
+		value: true,
+	}
+}
+
+func (o *withInterpolateKeys) metaOption() {}
+
+func (o *withInterpolateKeys) SetParserOption(c *parserConfig) {
+	c.InterpolateKeys = o.value
+}
+
+var _ parserOption = &withDefaultLang{}
+
+type withDefaultLang struct {
+	value string
+}
+
+// WithDefaultLang is a functional option that sets the language GetLocalized
+// falls back to when a value isn't available in the requested language.
+func WithDefaultLang(lang string) Option {
+	return &withDefaultLang{
+		value: lang,
+	}
+}
+
+func (o *withDefaultLang) metaOption() {}
+
+func (o *withDefaultLang) SetParserOption(c *parserConfig) {
+	c.DefaultLang = o.value
+}
+
+var _ parserOption = &withNamedFormats{}
+
+type withNamedFormats struct {
+	value bool
+}
+
+// WithNamedFormats is a functional option that also accepts the name of a
+// format (yaml, yml, toml, json or csv, in any case) in place of its signal,
+// followed by whitespace. A named block is closed by the close token, optionally
+// preceded by the name (e.g. `<!--yaml ... yaml-->`).
+func WithNamedFormats() Option {
+	return &withNamedFormats{
+		value: true,
+	}
+}
+
+func (o *withNamedFormats) metaOption() {}
+
+func (o *withNamedFormats) SetParserOption(c *parserConfig) {
+	c.NamedFormats = o.value
+}
+
+var _ parserOption = &withAutoDetect{}
+
+type withAutoDetect struct {
+	value bool
+}
+
+// WithAutoDetect is a functional option that also accepts metadata blocks
+// without a signal (`<!-- ... -->`), detecting whether they're JSON, TOML or
+// YAML from their content. If the detected format fails to decode, the
+// others are tried before reporting its error.
+func WithAutoDetect() Option {
+	return &withAutoDetect{
+		value: true,
+	}
+}
+
+func (o *withAutoDetect) metaOption() {}
+
+func (o *withAutoDetect) SetParserOption(c *parserConfig) {
+	c.AutoDetect = o.value
+}
+
+var _ parserOption = &withMaxBlockSize{}
+
+type withMaxBlockSize struct {
+	value int
+}
+
+// WithMaxBlockSize is a functional option that closes a metadata block once
+// it exceeds `n` bytes, treating it as a parsing error. The line exceeding
+// the limit and everything after it are parsed as markdown, so a block
+// missing its close token can't consume the document. Values below 1 are
+// ignored.
+func WithMaxBlockSize(n int) Option {
+	return &withMaxBlockSize{
+		value: n,
+	}
+}
+
+func (o *withMaxBlockSize) metaOption() {}
+
+func (o *withMaxBlockSize) SetParserOption(c *parserConfig) {
+	c.MaxBlockSize = o.value
+}
+
+var _ parserOption = &withBaseMetadata{}
+
+type withBaseMetadata struct {
+	value metadata
+}
+
+// WithBaseMetadata is a functional option that merges parsed metadata on top
+// of a copy of `m`, so that keys missing from a document are inherited from
+// `m`. Nested maps are merged rather than replaced.
+func WithBaseMetadata(m metadata) Option {
+	return &withBaseMetadata{
+		value: m,
+	}
+}
+
+func (o *withBaseMetadata) metaOption() {}
+
+func (o *withBaseMetadata) SetParserOption(c *parserConfig) {
+	c.BaseMetadata = o.value
+}
+
+var _ parserOption = &withFileReferences{}
+
+type withFileReferences struct {
+	value fs.FS
+}
+
+// WithFileReferences is a functional option that replaces string values of
+// the form "@file:<path>" with the contents of <path> in `fsys`.
+// Files that can't be read are treated as a parsing error.
+func WithFileReferences(fsys fs.FS) Option {
+	return &withFileReferences{
+		value: fsys,
+	}
+}
+
+func (o *withFileReferences) metaOption() {}
+
+func (o *withFileReferences) SetParserOption(c *parserConfig) {
+	c.FileReferences = o.value
+}
+
+var _ parserOption = &withStrictJSON{}
+
+type withStrictJSON struct {
+	value bool
+}
+
+// WithStrictJSON is a functional option that treats JSON metadata with
+// duplicate keys in any object as a parsing error, rather than keeping the
+// last value.
+func WithStrictJSON() Option {
+	return &withStrictJSON{
+		value: true,
+	}
+}
+
+func (o *withStrictJSON) metaOption() {}
+
+func (o *withStrictJSON) SetParserOption(c *parserConfig) {
+	c.StrictJSON = o.value
+}
+
+var _ parserOption = &withNormalizeDates{}
+
+type withNormalizeDates struct {
+	value bool
+}
+
+// WithNormalizeDates is a functional option that converts string values
+// that are entirely a date or datetime (see dateLayouts) to time.Time, so
+// that dates are the same type in every format.
+func WithNormalizeDates() Option {
+	return &withNormalizeDates{
+		value: true,
+	}
+}
+
+func (o *withNormalizeDates) metaOption() {}
+
+func (o *withNormalizeDates) SetParserOption(c *parserConfig) {
+	c.NormalizeDates = o.value
+}
+
+var _ parserOption = &withLocation{}
+
+type withLocation struct {
+	value *time.Location
+}
+
+// WithLocation is a functional option that sets the location dates and
+// datetimes without a zone are read in by WithNormalizeDates. By default
+// they are read in UTC.
+func WithLocation(loc *time.Location) Option {
+	return &withLocation{
+		value: loc,
+	}
+}
+
+func (o *withLocation) metaOption() {}
+
+func (o *withLocation) SetParserOption(c *parserConfig) {
+	c.Location = o.value
+}
+
+var _ parserOption = &withUniformClose{}
+
+type withUniformClose struct {
+	value bool
+}
+
+// WithUniformClose is a functional option that also accepts the close token
+// without the signal before it (e.g. `<!--: ... -->`) in every format.
+func WithUniformClose() Option {
+	return &withUniformClose{
+		value: true,
+	}
+}
+
+func (o *withUniformClose) metaOption() {}
+
+func (o *withUniformClose) SetParserOption(c *parserConfig) {
+	c.UniformClose = o.value
+}
+
+var _ parserOption = &withCompatKeys{}
+
+type withCompatKeys struct {
+	value []parser.ContextKey
+}
+
+// WithCompatKeys is a functional option that also stores successfully parsed
+// metadata in the parser.Context under each of `keys`, as a
+// map[string]interface{}, for code expecting it there.
+func WithCompatKeys(keys ...parser.ContextKey) Option {
+	return &withCompatKeys{
+		value: keys,
+	}
+}
+
+func (o *withCompatKeys) metaOption() {}
+
+func (o *withCompatKeys) SetParserOption(c *parserConfig) {
+	c.CompatKeys = append(c.CompatKeys, o.value...)
+}
+
+var _ parserOption = &withAllowedKeys{}
+
+type withAllowedKeys struct {
+	value []string
+}
+
+// WithAllowedKeys is a functional option that treats top-level keys other
+// than `keys` as a parsing error. Use WithValidator or WithSchema to
+// require keys to be present.
+func WithAllowedKeys(keys ...string) Option {
+	return &withAllowedKeys{
+		value: keys,
+	}
+}
+
+func (o *withAllowedKeys) metaOption() {}
+
+func (o *withAllowedKeys) SetParserOption(c *parserConfig) {
+	if c.AllowedKeys == nil {
+		c.AllowedKeys = make(map[string]bool)
+	}
+	for _, k := range o.value {
+		c.AllowedKeys[k] = true
+	}
+}
+
+var _ parserOption = &withEnum{}
+
+type withEnum struct {
+	key     string
+	allowed []string
+}
+
+// WithEnum is a functional option that treats a `key` with a value other
+// than one of the `allowed` strings as a parsing error. Metadata without
+// `key` isn't an error. It can be used multiple times for different keys.
+func WithEnum(key string, allowed ...string) Option {
+	return &withEnum{
+		key:     key,
+		allowed: allowed,
+	}
+}
+
+func (o *withEnum) metaOption() {}
+
+func (o *withEnum) SetParserOption(c *parserConfig) {
+	if c.Enums == nil {
+		c.Enums = make(map[string][]string)
+	}
+	c.Enums[o.key] = o.allowed
+}
+
+// checkEnums returns an error for the first key of `m`, in sorted order, with
+// a value that isn't allowed by `enums`, see WithEnum.
+func checkEnums(m metadata, enums map[string][]string) error {
+	keys := make([]string, 0, len(enums))
+	for k := range enums {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v, ok := m[k]
+		if !ok {
+			continue
+		}
+		if s, ok := v.(string); !ok || !containsString(enums[k], s) {
+			return fmt.Errorf("meta: %s: %#v is not one of %s", k, v, strings.Join(enums[k], ", "))
+		}
+	}
+	return nil
+}
+
+// containsString reports whether `s` is in `list`.
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+var _ parserOption = &withSkipFirstLineIf{}
+
+type withSkipFirstLineIf struct {
+	value string
+}
+
+// WithSkipFirstLineIf is a functional option that, if the first line of a
+// document starts with `prefix` (e.g. "#!"), accepts a metadata block on the
+// second line instead and removes the first line from the output.
+func WithSkipFirstLineIf(prefix string) Option {
+	return &withSkipFirstLineIf{
+		value: prefix,
+	}
+}
+
+func (o *withSkipFirstLineIf) metaOption() {}
+
+func (o *withSkipFirstLineIf) SetParserOption(c *parserConfig) {
+	c.SkipFirstLineIf = o.value
+}
+
+// skipsFirstLine reports whether the first line of `source` is skipped, see
+// WithSkipFirstLineIf.
+func (c *parserConfig) skipsFirstLine(source []byte) bool {
+	return len(c.SkipFirstLineIf) > 0 && bytes.HasPrefix(source, []byte(c.SkipFirstLineIf))
+}
+
+// isBanner reports whether `head` only contains HTML comments, doctypes and
+// blank lines, such as a license banner before the metadata block.
+func (b *metaParser) isBanner(head []byte) bool {
+	for {
+		head = util.TrimLeftSpace(head)
+		var end []byte
+		if len(head) == 0 {
+			return true
+		} else if bytes.HasPrefix(head, []byte("<!--")) {
+			line := head
+			if i := bytes.IndexByte(head, '\n'); i != -1 {
+				line = head[:i]
+			}
+			if b.isOpen(line) {
+				return false
+			}
+			end = []byte("-->")
+		} else if len(head) > 9 && strings.EqualFold(string(head[:9]), "<!doctype") {
+			end = []byte(">")
+		} else {
+			return false
+		}
+		i := bytes.Index(head, end)
+		if i == -1 {
+			return false
+		}
+		head = head[i+len(end):]
+	}
+}
+
+var _ parserOption = &withRejectEmpty{}
+
+type withRejectEmpty struct {
+	value bool
+}
+
+// WithRejectEmpty is a functional option that treats a metadata block
+// without any keys as a parsing error, see ErrEmptyMetadata. A document
+// without a metadata block is not an error.
+func WithRejectEmpty() Option {
+	return &withRejectEmpty{
+		value: true,
+	}
+}
+
+func (o *withRejectEmpty) metaOption() {}
+
+func (o *withRejectEmpty) SetParserOption(c *parserConfig) {
+	c.RejectEmpty = o.value
+}
+
+var _ parserOption = &withKeyStyle{}
+
+type withKeyStyle struct {
+	value string
+}
+
+// WithKeyStyle is a functional option that rewrites the top-level keys of
+// the metadata to the naming convention `style`, one of "snake"
+// (publish_date), "camel" (publishDate) or "kebab" (publish-date). Keys are
+// split into words at underscores, hyphens, spaces and changes of case, so
+// "PublishDate", "publishDate" and "publish_date" are the same key. Two keys
+// that are rewritten to the same key are a parsing error, as is an unknown
+// `style`.
+func WithKeyStyle(style string) Option {
+	return &withKeyStyle{
+		value: style,
+	}
+}
+
+func (o *withKeyStyle) metaOption() {}
+
+func (o *withKeyStyle) SetParserOption(c *parserConfig) {
+	var ok bool
+	if c.KeyStyle, ok = keyStyles[strings.ToLower(o.value)]; !ok {
+		c.KeyStyleError = fmt.Errorf("meta: unknown key style %q", o.value)
+	} else {
+		c.KeyStyleError = nil
+	}
+}
+
+// keyStyles are the naming conventions supported by WithKeyStyle.
+var keyStyles = map[string]func(string) string{
+	"snake": func(key string) string {
+		return strings.Join(keyWords(key), "_")
+	},
+	"kebab": func(key string) string {
+		return strings.Join(keyWords(key), "-")
+	},
+	"camel": func(key string) string {
+		words := keyWords(key)
+		for i := 1; i < len(words); i++ {
+			r, n := utf8.DecodeRuneInString(words[i])
+			words[i] = strings.ToUpper(string(r)) + words[i][n:]
+		}
+		return strings.Join(words, "")
+	},
+}
+
+// keyWords returns the lower case words of `key`, split at underscores,
+// hyphens, spaces and changes of case, e.g. "HTMLTitle" becomes "html" and
+// "title".
+func keyWords(key string) []string {
+	var words []string
+	start := -1
+	for i := 0; i <= len(key); i++ {
+		if i == len(key) || key[i] == '_' || key[i] == '-' || key[i] == ' ' {
+			if start >= 0 {
+				words = append(words, strings.ToLower(key[start:i]))
+			}
+			start = -1
+			continue
+		}
+		if start >= 0 && isUpper(key[i]) && (!isUpper(key[i-1]) ||
+			(i+1 < len(key) && isLower(key[i+1]))) {
+			words = append(words, strings.ToLower(key[start:i]))
+			start = i
+		} else if start < 0 {
+			start = i
+		}
+	}
+	return words
+}
+
+func isUpper(c byte) bool {
+	return c >= 'A' && c <= 'Z'
+}
+
+func isLower(c byte) bool {
+	return c >= 'a' && c <= 'z'
+}
+
+// applyKeyStyle rewrites the top-level keys of `m` with `style`, returning an
+// error if two keys are rewritten to the same key.
+func applyKeyStyle(m metadata, style func(string) string) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	from := make(map[string]string, len(keys))
+	styled := make(metadata, len(keys))
+	for _, k := range keys {
+		key := k
+		if k != csvRowsKey && k != jsonListKey {
+			if key = style(k); key == "" {
+				key = k
+			}
+		}
+		if other, ok := from[key]; ok {
+			return fmt.Errorf("meta: keys %q and %q are both %q", other, k, key)
+		}
+		from[key] = k
+		styled[key] = m[k]
+	}
+	for k := range m {
+		delete(m, k)
+	}
+	for k, v := range styled {
+		m[k] = v
+	}
+	return nil
+}
+
+var _ parserOption = &withMultipleBlocks{}
+
+type withMultipleBlocks struct {
+	value bool
+}
+
+// WithMultipleBlocks is a functional option that also parses metadata blocks
+// following the first, with only blank lines between them, merging each
+// over the metadata before it. Each block can be in a different format, and
+// is processed by the other options before it's merged.
+func WithMultipleBlocks() Option {
+	return &withMultipleBlocks{
+		value: true,
+	}
+}
+
+func (o *withMultipleBlocks) metaOption() {}
+
+func (o *withMultipleBlocks) SetParserOption(c *parserConfig) {
+	c.MultipleBlocks = o.value
+}
+
+// merge merges the metadata of `d` over `prev`, the data of the block before
+// it, see WithMultipleBlocks.
+func (d *data) merge(prev *data) {
+	d.Start = prev.Start
+	if prev.Error != nil {
+		d.Error = prev.Error
+	}
+	if d.Error != nil {
+		return
+	}
+	if prev.Keys != nil {
+		for _, k := range d.Keys {
+			if _, ok := prev.Map[k]; !ok {
+				prev.Keys = append(prev.Keys, k)
+			}
+		}
+		d.Keys = prev.Keys
+	}
+	if prev.Order != nil && d.Order != nil {
+		for k, o := range d.Order.sub {
+			prev.Order.sub[k] = o
+		}
+		d.Order = prev.Order
+	}
+	if prev.Spans != nil {
+		for k, span := range d.Spans {
+			prev.Spans[k] = span
+		}
+		d.Spans = prev.Spans
+	}
+	m := normalize(prev.Map).(map[string]interface{})
+	mergeMeta(m, normalize(d.Map).(map[string]interface{}))
+	d.Map = m
+}
+
+var _ parserOption = &withPlaceholder{}
+
+type withPlaceholder struct {
+	value string
+}
+
+// WithPlaceholder is a functional option that replaces the metadata block
+// with `text` (e.g. "<!--META-->") in the output, rendered as raw HTML, so
+// that it can be substituted later. It takes precedence over
+// WithPreserveComment.
+func WithPlaceholder(text string) Option {
+	return &withPlaceholder{
+		value: text,
+	}
+}
+
+func (o *withPlaceholder) metaOption() {}
+
+func (o *withPlaceholder) SetParserOption(c *parserConfig) {
+	c.Placeholder = o.value
+}
+
+var _ parserOption = &withReportUnknownSignal{}
+
+type withReportUnknownSignal struct {
+	value bool
+}
+
+// WithReportUnknownSignal is a functional option that treats a comment at
+// the start of the document that opens with an unsupported signal, such as
+// "<!--@", as a parsing error wrapping ErrUnknownSignal. Without it, the
+// comment is left as HTML.
+func WithReportUnknownSignal() Option {
+	return &withReportUnknownSignal{
+		value: true,
+	}
+}
+
+func (o *withReportUnknownSignal) metaOption() {}
+
+func (o *withReportUnknownSignal) SetParserOption(c *parserConfig) {
+	c.ReportUnknownSignal = o.value
+}
+
+// unknownSignal returns the signal of `line` if it opens with the open token
+// followed by punctuation that isn't a supported signal, see
+// WithReportUnknownSignal.
+func (b *metaParser) unknownSignal(line []byte) (byte, bool) {
+	line = util.TrimLeftSpace(line)
+	if !bytes.HasPrefix(line, []byte(b.OpenToken)) || len(line) == len(b.OpenToken) {
+		return 0, false
+	}
+	signal := line[len(b.OpenToken)]
+	if !util.IsPunct(signal) || signal == '-' || signal == '>' || b.isOpen(line) {
+		return 0, false
+	}
+	return signal, true
+}
+
+var _ parserOption = &withEnvironment{}
+
+type withEnvironment struct {
+	name   string
+	others []string
+}
+
+// WithEnvironment is a functional option that merges the keys of the
+// top-level map `name` (e.g. "production") over the other top-level keys,
+// then removes it and the maps of any `others` environments (e.g. "staging").
+func WithEnvironment(name string, others ...string) Option {
+	return &withEnvironment{
+		name:   name,
+		others: others,
+	}
+}
+
+func (o *withEnvironment) metaOption() {}
+
+func (o *withEnvironment) SetParserOption(c *parserConfig) {
+	c.Environment = o.name
+	c.Environments = append([]string{o.name}, o.others...)
+}
+
+var _ parserOption = &withDeriveSlug{}
+
+type withDeriveSlug struct {
+	value func(metadata) string
+}
+
+// WithDeriveSlug is a functional option that sets the "Slug" key to the
+// result of `fn` when neither "Slug" or "slug" are set, unless it's empty.
+// If `fn` is nil, then the slug is derived from "Title" (or "title") by
+// lowercasing it and joining its words with hyphens.
+func WithDeriveSlug(fn func(m metadata) string) Option {
+	if fn == nil {
+		fn = slugify
+	}
+	return &withDeriveSlug{
+		value: fn,
+	}
+}
+
+func (o *withDeriveSlug) metaOption() {}
+
+func (o *withDeriveSlug) SetParserOption(c *parserConfig) {
+	c.DeriveSlug = o.value
+}
+
+// slugify returns the title of `m` as a slug, e.g. "Hello World" becomes
+// "hello-world".
+func slugify(m metadata) string {
+	title, ok := m["Title"].(string)
+	if !ok {
+		title, _ = m["title"].(string)
+	}
+	var slug strings.Builder
+	hyphen := false
+	for _, r := range strings.ToLower(title) {
+		if r < utf8.RuneSelf && !util.IsAlphaNumeric(byte(r)) {
+			hyphen = slug.Len() > 0
+			continue
+		} else if hyphen {
+			slug.WriteByte('-')
+			hyphen = false
+		}
+		slug.WriteRune(r)
+	}
+	return slug.String()
+}
+
+var _ parserOption = &withYAMLMapSlice{}
+
+type withYAMLMapSlice struct {
+	value bool
+}
+
+// WithYAMLMapSlice is a functional option that records the order of the
+// keys of YAML metadata at every level, so that it can be got with
+// GetOrdered. WithOrderedKeys only records the order of the top-level keys.
+func WithYAMLMapSlice() Option {
+	return &withYAMLMapSlice{
+		value: true,
+	}
+}
+
+func (o *withYAMLMapSlice) metaOption() {}
+
+func (o *withYAMLMapSlice) SetParserOption(c *parserConfig) {
+	c.YAMLMapSlice = o.value
+}
+
+var _ parserOption = &withKeySpans{}
+
+type withKeySpans struct {
+	value bool
+}
+
+// WithKeySpans is a functional option that records where each top-level key
+// of YAML metadata is in the source, see KeySpans.
+func WithKeySpans() Option {
+	return &withKeySpans{
+		value: true,
+	}
+}
+
+func (o *withKeySpans) metaOption() {}
+
+func (o *withKeySpans) SetParserOption(c *parserConfig) {
+	c.KeySpans = o.value
+}
+
+var _ parserOption = &withLenientJSON{}
+
+type withLenientJSON struct {
+	value bool
+}
+
+// WithLenientJSON is a functional option that allows `//` and `/* */`
+// comments and trailing commas in JSON metadata, which are removed before
+// it's decoded.
+func WithLenientJSON() Option {
+	return &withLenientJSON{
+		value: true,
+	}
+}
+
+func (o *withLenientJSON) metaOption() {}
+
+func (o *withLenientJSON) SetParserOption(c *parserConfig) {
+	c.LenientJSON = o.value
+}
+
+var _ parserOption = &withOnParsed{}
+
+type withOnParsed struct {
+	value func(metadata)
+}
+
+// WithOnParsed is a functional option that calls `fn` with the metadata of
+// each metadata block, once it's been processed by the other options. `fn`
+// isn't called if there's a parsing error.
+func WithOnParsed(fn func(metadata)) Option {
+	return &withOnParsed{
+		value: fn,
+	}
+}
+
+func (o *withOnParsed) metaOption() {}
+
+func (o *withOnParsed) SetParserOption(c *parserConfig) {
+	c.OnParsed = o.value
+}
+
+var _ parserOption = &withWarningHandler{}
+
+type withWarningHandler struct {
+	value func(string)
+}
+
+// WithWarningHandler is a functional option that calls `fn` with a message
+// for issues in metadata that aren't treated as errors, such as the use of
+// an alias set with WithKeyAliases.
+func WithWarningHandler(fn func(string)) Option {
+	return &withWarningHandler{
+		value: fn,
+	}
+}
+
+func (o *withWarningHandler) metaOption() {}
+
+func (o *withWarningHandler) SetParserOption(c *parserConfig) {
+	c.WarningHandler = o.value
+}
+
+// warn passes a warning to the handler set with WithWarningHandler, if any.
+func (c *parserConfig) warn(format string, a ...interface{}) {
+	if c.WarningHandler != nil {
+		c.WarningHandler(fmt.Sprintf(format, a...))
+	}
+}
+
+var _ parserOption = &withTypes{}
+
+type withTypes struct {
+	value map[string]string
+}
+
+// WithTypes is a functional option that converts the values of the
+// top-level keys in `types` to the type they're mapped to: "int", "float",
+// "bool", "string", "[]string" or "time" (see dateLayouts). Values that
+// can't be converted are treated as a parsing error.
+func WithTypes(types map[string]string) Option {
+	return &withTypes{
+		value: types,
+	}
+}
+
+func (o *withTypes) metaOption() {}
+
+func (o *withTypes) SetParserOption(c *parserConfig) {
+	c.Types = o.value
+}
+
+var _ parserOption = &withAltCloseToken{}
+
+type withAltCloseToken struct {
+	value string
+}
+
+// WithAltCloseToken is a functional option that also accepts `token` in
+// place of the close token (e.g. `<!--: ... :--#`).
+func WithAltCloseToken(token string) Option {
+	return &withAltCloseToken{
+		value: token,
+	}
+}
+
+func (o *withAltCloseToken) metaOption() {}
+
+func (o *withAltCloseToken) SetParserOption(c *parserConfig) {
+	c.AltCloseToken = o.value
+}
+
+var _ parserOption = &withMaxDepth{}
+
+type withMaxDepth struct {
+	value int
+}
+
+// WithMaxDepth is a functional option that treats metadata nested more than
+// `n` levels of maps and lists deep as a parsing error, counting the
+// top-level map as the first level. Values below 1 are ignored.
+func WithMaxDepth(n int) Option {
+	return &withMaxDepth{
+		value: n,
+	}
+}
+
+func (o *withMaxDepth) metaOption() {}
+
+func (o *withMaxDepth) SetParserOption(c *parserConfig) {
+	c.MaxDepth = o.value
+}
+
+// Cache stores decoded metadata by key, see WithCache.
+type Cache interface {
+	// Get returns the metadata stored under `key`, if there is any.
+	Get(key string) (map[string]interface{}, bool)
+	// Set stores `m` under `key`.
+	Set(key string, m map[string]interface{})
+}
+
+var _ parserOption = &withCache{}
+
+type withCache struct {
+	value Cache
+}
+
+// WithCache is a functional option that looks up decoded metadata in `c`,
+// keyed by a hash of the format and contents of the metadata block, before
+// decoding it. Metadata is stored before it's processed by the other
+// options, so they still apply on a cache hit. The key also covers the
+// options that change how a block is decoded (such as WithStrictJSON), so a
+// Cache can be shared by parsers with different options. Decoders
+// registered with WithDecoder are told apart by their function, so closures
+// of the same function that decode differently must not share a Cache.
+// Blocks using WithAutoDetect aren't cached.
+func WithCache(c Cache) Option {
+	return &withCache{
+		value: c,
+	}
+}
+
+func (o *withCache) metaOption() {}
+
+func (o *withCache) SetParserOption(c *parserConfig) {
+	c.Cache = o.value
+}
+
+var _ parserOption = &withYAMLKnownFields{}
+
+type withYAMLKnownFields struct {
+	value reflect.Type
+}
+
+// WithYAMLKnownFields is a functional option that treats YAML metadata that
+// can't be decoded into the struct (or pointer to struct) `v` as a parsing
+// error, using the KnownFields option of gopkg.in/yaml.v3: keys that aren't
+// fields of `v` and values of the wrong type are rejected.
+func WithYAMLKnownFields(v interface{}) Option {
+	t := reflect.TypeOf(v)
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return &withYAMLKnownFields{
+		value: t,
+	}
+}
+
+func (o *withYAMLKnownFields) metaOption() {}
+
+func (o *withYAMLKnownFields) SetParserOption(c *parserConfig) {
+	if o.value != nil && o.value.Kind() == reflect.Struct {
+		c.YAMLKnownFields = o.value
+	}
+}
+
+var _ parserOption = &withBuildVars{}
+
+type withBuildVars struct {
+	value map[string]string
+}
+
+// WithBuildVars is a functional option that accepts a guard of
+// comma-separated key=value pairs after the signal of a metadata block, e.g.
+// "<!--:[env=prod]". A block is only parsed if each key has that value in
+// `vars`, otherwise it's skipped and rendered as nothing. Guarded blocks can
+// follow each other at the start of the document. JSON blocks can't have a
+// guard.
+func WithBuildVars(vars map[string]string) Option {
+	return &withBuildVars{
+		value: vars,
+	}
+}
+
+func (o *withBuildVars) metaOption() {}
+
+func (o *withBuildVars) SetParserOption(c *parserConfig) {
+	c.BuildVars = o.value
+}
+
+// setGuard matches the guard at the start of `line` against the BuildVars,
+// recording the result, and returns the length of the guard.
+func (b *metaParser) setGuard(line []byte) int {
+	if b.BuildVars == nil || !bytes.HasPrefix(line, []byte("[")) {
+		return 0
+	}
+	end := bytes.IndexByte(line, ']')
+	if end == -1 {
+		return 0
+	}
+	b.guarded = true
+	for _, cond := range strings.Split(string(line[1:end]), ",") {
+		kv := strings.SplitN(cond, "=", 2)
+		if len(kv) != 2 {
+			b.unmatched = true
+			continue
+		}
+		v, ok := b.BuildVars[strings.TrimSpace(kv[0])]
+		b.unmatched = b.unmatched || !ok || v != strings.TrimSpace(kv[1])
+	}
+	return end + 1
+}
+
+// followsBlock reports whether the line `reader` is at opens a block
+// following another block, with only blank lines between them, that should
+// also be parsed, see WithMultipleBlocks and WithBuildVars.
+func (b *metaParser) followsBlock(reader text.Reader, pc parser.Context) bool {
+	if b.BuildVars == nil && !b.MultipleBlocks {
+		return false
+	}
+	prev, ok := pc.Get(blockKey).(*metaParser)
+	if !ok || !prev.closed || !sameSource(prev.source, reader.Source()) {
+		return false
+	} else if !prev.guarded && !b.MultipleBlocks {
+		return false
+	}
+	line, segment := reader.PeekLine()
+	if prev.stop > segment.Start || !util.IsBlank(reader.Source()[prev.stop:segment.Start]) || !b.isOpen(line) {
+		return false
+	} else if b.MultipleBlocks {
+		return true
+	}
+	next := &metaParser{parserConfig: b.parserConfig}
+	line = util.TrimLeftSpace(line)[len(b.OpenToken):]
+	return next.setGuard(line[next.setFormat(line):]) > 0
+}
+
+var _ parserOption = &withLenientClose{}
+
+type withLenientClose struct {
+	value bool
+}
+
+// WithLenientClose is a functional option that also closes YAML metadata
+// blocks at a line of just "---", for files from generators that close the
+// block that way. A "---" line can't be used within the YAML.
+func WithLenientClose() Option {
+	return &withLenientClose{
+		value: true,
+	}
+}
+
+func (o *withLenientClose) metaOption() {}
+
+func (o *withLenientClose) SetParserOption(c *parserConfig) {
+	c.LenientClose = o.value
+}
+
+var _ parserOption = &withFormats{}
+
+type withFormats struct {
+	value []string
+}
+
+// WithFormats is a functional option that only accepts metadata blocks in
+// the named `formats` (yaml, toml, json or csv), ignoring other signals
+// before they're scanned. When restricted this way, JSON is decoded with
+// encoding/json directly.
+func WithFormats(formats ...string) Option {
+	return &withFormats{
+		value: formats,
+	}
+}
+
+func (o *withFormats) metaOption() {}
+
+func (o *withFormats) SetParserOption(c *parserConfig) {
+	c.Formats = make(map[byte]bool)
+	for _, name := range o.value {
+		if format, ok := formatNames[strings.ToLower(name)]; ok {
+			c.Formats[format] = true
+			if format == formatJsonClose {
+				c.Formats[formatJsonListClose] = true
+			}
+		}
+	}
+}
+
+var _ parserOption = &withMaxAliasExpansion{}
+
+type withMaxAliasExpansion struct {
+	value int
+}
+
+// WithMaxAliasExpansion is a functional option that treats YAML metadata
+// with aliases expanding to more than `n` nodes as a parsing error, checked
+// before it's decoded, to guard against "billion laughs" style documents.
+// An alias expands to every node in the value it refers to, including the
+// values of the aliases within it. Values below 1 are ignored.
+func WithMaxAliasExpansion(n int) Option {
+	return &withMaxAliasExpansion{
+		value: n,
+	}
+}
+
+func (o *withMaxAliasExpansion) metaOption() {}
+
+func (o *withMaxAliasExpansion) SetParserOption(c *parserConfig) {
+	c.MaxAliasExpansion = o.value
+}
+
+// accepts reports whether blocks in `format` are accepted, see WithFormats.
+func (c *parserConfig) accepts(format byte) bool {
+	return c.Formats == nil || c.Formats[format]
+}
+
+// isLenientClose reports whether `line` closes a YAML block, see
+// WithLenientClose.
+func (b *metaParser) isLenientClose(line []byte) bool {
+	return b.LenientClose && b.format == formatYaml && bytes.Equal(util.TrimRightSpace(line), []byte("---"))
+}
+
+// formatName returns the format name at the start of `line`, if it's followed
+// by whitespace and the WithNamedFormats option was used.
+func (b *metaParser) formatName(line []byte) (string, bool) {
+	if !b.NamedFormats {
+		return "", false
+	}
+	n := 0
+	for n < len(line) && util.IsAlphaNumeric(line[n]) {
+		n++
+	}
+	if n < len(line) && !util.IsSpace(line[n]) {
+		return "", false
+	}
+	_, ok := formatNames[strings.ToLower(string(line[:n]))]
+	return string(line[:n]), ok
+}
+
+// setFormat sets the format of the block from `line`, which follows the open
+// token, and returns the number of bytes in `line` that aren't metadata.
+func (b *metaParser) setFormat(line []byte) int {
+	if name, ok := b.formatName(line); ok {
+		b.format, b.named = formatNames[strings.ToLower(name)], name
+		return len(name)
+	} else if b.AutoDetect && (len(line) == 0 || util.IsSpace(line[0])) {
+		b.format = formatAuto
+		return 0
+	}
+	if b.format = closeSignal(line[0]); isJson(b.format) {
+		return 0
+	}
+	return 1
+}
+
+// plainClose reports whether the current block is closed by the close token
+// alone, rather than the signal and close token.
+func (b *metaParser) plainClose() bool {
+	return b.named != "" || b.format == formatAuto
+}
+
+// isOpen reports whether `line` starts with the open token followed by a
+// signal.
+func (b *metaParser) isOpen(line []byte) bool {
+	line = util.TrimRightSpace(util.TrimLeftSpace(line))
+	if !bytes.HasPrefix(line, []byte(b.OpenToken)) {
+		return false
+	} else if len(line) == len(b.OpenToken) {
+		return b.AutoDetect
+	}
+	signal := line[len(b.OpenToken)]
+	switch signal {
+	case formatYaml:
+		fallthrough
+	case formatToml:
+		fallthrough
+	case formatJsonOpen:
+		fallthrough
+	case formatJsonListOpen:
+		fallthrough
+	case formatCsv:
+		return b.accepts(closeSignal(signal))
+	default:
+		if _, ok := b.Decoders[signal]; ok {
+			return true
+		} else if name, ok := b.formatName(line[len(b.OpenToken):]); ok {
+			return b.accepts(formatNames[strings.ToLower(name)])
+		}
+	}
+	return b.AutoDetect && util.IsSpace(signal)
+}
+
+// isClose will check `line` for the closing token.
+// If found, the integer returned will be the *nth* byte of `line` that the
+// metadata ends at: the signal before the close token, or for JSON the byte
+// after the closing bracket. If not found, then -1 is returned.
+// Use closeEnd to find the end of the close token.
+// For YAML and TOML, anything after an unquoted comment marker is ignored.
+// For JSON, whitespace is allowed between the closing bracket and the close
+// token, including newlines if the previous line ended with the bracket.
+func (b *metaParser) isClose(line []byte) int {
+	//line = util.TrimRightSpace(util.TrimLeftSpace(line))
+	if b.isLenientClose(line) {
+		return 0
+	} else if isJson(b.format) && !b.plainClose() {
+		if trimmed := util.TrimLeftSpace(line); b.brace && b.closeToken(trimmed, bytes.HasPrefix) != "" {
+			return len(line) - len(trimmed)
+		}
+	}
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		if b.plainClose() {
+			if b.closeToken(line[i:], bytes.HasPrefix) != "" {
+				if n := i - len(b.named); n >= 0 && bytes.EqualFold(line[n:i], []byte(b.named)) {
+					return n
+				}
+				return i
+			}
+		} else if line[i] == b.format && isJson(b.format) {
+			if b.closeToken(util.TrimLeftSpace(line[i+1:]), bytes.HasPrefix) != "" {
+				return i + 1
+			}
+		} else if line[i] == b.format && b.closeToken(line[i+1:], bytes.HasPrefix) != "" {
+			return i
+		} else if b.UniformClose && b.closeToken(line[i:], bytes.HasPrefix) != "" {
+			return i
+		}
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case (c == '"' || c == '\'') && startsScalar(line, i):
+			quote = c
+		case c == '#' && b.isComment(line, i):
+			return -1
+		}
+	}
+	return -1
+}
+
+// closeEnd returns the index in `line` after the close token found at `n` by
+// isClose.
+func (b *metaParser) closeEnd(line []byte, n int) int {
+	if n == 0 && b.isLenientClose(line) {
+		return len("---")
+	}
+	start, end := -1, -1
+	for _, token := range []string{b.CloseToken, b.AltCloseToken} {
+		i := bytes.Index(line[n:], []byte(token))
+		if len(token) == 0 || i == -1 {
+			continue
+		} else if start == -1 || i < start || (i == start && n+i+len(token) > end) {
+			start, end = i, n+i+len(token)
+		}
+	}
+	return end
+}
+
+// closeToken returns the close token, or the alternative set with
+// WithAltCloseToken, for which `match(line, token)` is true.
+func (b *metaParser) closeToken(line []byte, match func([]byte, []byte) bool) string {
+	for _, token := range []string{b.CloseToken, b.AltCloseToken} {
+		if len(token) > 0 && match(line, []byte(token)) {
+			return token
+		}
+	}
+	return ""
+}
+
+// unescapeClose returns `buf` with escaped close tokens replaced by the
+// token. A close token is escaped with a backslash before its last byte,
+// e.g. "--\>", so that it can be used in values without closing the block.
+func (b *metaParser) unescapeClose(buf []byte) []byte {
+	for _, token := range []string{b.CloseToken, b.AltCloseToken} {
+		if n := len(token); n > 0 {
+			escaped := token[:n-1] + "\\" + token[n-1:]
+			buf = bytes.ReplaceAll(buf, []byte(escaped), []byte(token))
+		}
+	}
+	return buf
+}
+
+// track records whether `line`, which doesn't close the current block, ends
+// with the closing bracket of a JSON block.
+func (b *metaParser) track(line []byte) {
+	if line = util.TrimRightSpace(line); isJson(b.format) && len(line) > 0 {
+		b.brace = line[len(line)-1] == b.format
+	}
+}
+
+// startsScalar reports whether the quote at `line[i]` starts a quoted value,
+// rather than being part of an unquoted one (e.g. "don't"). A quoted value
+// starts a line or follows a key, list item or flow indicator.
+func startsScalar(line []byte, i int) bool {
+	prev := util.TrimRightSpace(line[:i])
+	if len(prev) == 0 {
+		return true
+	}
+	switch prev[len(prev)-1] {
+	case ':', '=', '-', '?', '[', '{', ',':
+		return true
+	}
+	return false
+}
+
+// isComment reports whether the `#` at `line[i]` starts a comment in the
+// current format.
+func (b *metaParser) isComment(line []byte, i int) bool {
+	switch b.format {
+	case formatYaml:
+		return i == 0 || util.IsSpace(line[i-1])
+	case formatToml:
+		return true
+	}
+	return false
+}
+
+func (b *metaParser) Trigger() []byte {
+	return []byte{b.OpenToken[0]}
+}
+
+// isTrailing reports whether the current line of `reader` opens a metadata
+// block that is only followed by blank lines. `reader` is not advanced.
+func (b *metaParser) isTrailing(reader text.Reader) bool {
+	line, segment := reader.PeekLine()
+	if !bytes.HasPrefix(line, []byte(b.OpenToken)) || !b.isOpen(line) {
+		return false
+	}
+	b.brace = false
+	rest := reader.Source()[segment.Start+len(b.OpenToken):]
+	rest = rest[b.setFormat(rest):]
+	for len(rest) > 0 {
+		end := bytes.IndexByte(rest, '\n') + 1
+		if end == 0 {
+			end = len(rest)
+		}
+		if n := b.isClose(rest[:end]); n != -1 {
+			return util.IsBlank(rest[b.closeEnd(rest, n):])
+		}
+		b.track(rest[:end])
+		rest = rest[end:]
+	}
+	return b.ImplicitClose
+}
+
+// block returns the metaParser holding the state of the block of `node`
+// being parsed with `pc`, which is kept out of `b` so that conversions can
+// run concurrently. The state of the previous block is also kept, since it's
+// closed after the block following it is opened.
+func (b *metaParser) block(pc parser.Context, node gast.Node) *metaParser {
+	for _, key := range []parser.ContextKey{blockKey, prevBlockKey} {
+		if s, ok := pc.Get(key).(*metaParser); ok && s.node == node {
+			return s
+		}
+	}
+	return b
+}
+
+func (b *metaParser) Open(parent gast.Node, reader text.Reader, pc parser.Context) (gast.Node, parser.State) {
+	linenum, _ := reader.Position()
+	if linenum == 1 && b.skipsFirstLine(reader.Source()) {
+		linenum = 0
+	} else if linenum != 0 && b.followsBlock(reader, pc) {
+		linenum = 0
+	} else if _, segment := reader.PeekLine(); linenum != 0 && b.isBanner(reader.Source()[:segment.Start]) {
+		linenum = 0
+	}
+	if linenum != 0 && !b.TrailingBlock {
+		return nil, parser.NoChildren
+	}
+	b = &metaParser{parserConfig: b.parserConfig}
+	if linenum != 0 && !b.isTrailing(reader) {
+		return nil, parser.NoChildren
+	}
+	line, segment := reader.PeekLine()
+
+	if b.isOpen(line) {
+		pc.Set(prevBlockKey, pc.Get(blockKey))
+		pc.Set(blockKey, b)
+		b.source = reader.Source()
+		b.start = segment.Start
+		reader.Advance(len(b.OpenToken))
+		line, _ = reader.PeekLine()
+		reader.Advance(b.setFormat(line))
+		line, _ = reader.PeekLine()
+		reader.Advance(b.setGuard(line))
+
+		node := gast.NewTextBlock()
+		b.node = node
+		b.closed, b.brace = false, false
+		if b.Continue(node, reader, pc) != parser.Close {
+			return node, parser.NoChildren
+		}
+		if rest, _ := reader.PeekLine(); util.IsBlank(rest) {
+			// closed on the line it opened on, Continue will close it
+			return node, parser.NoChildren
+		}
+		parent.AppendChild(parent, node)
+		b.Close(node, reader, pc)
+	} else if signal, ok := b.unknownSignal(line); ok && b.ReportUnknownSignal && linenum == 0 {
+		pc.Set(contextKey, &data{
+			Source: reader.Source(),
+			Config: b.parserConfig,
+			Start:  segment.Start,
+			Stop:   segment.Start,
+			Error:  fmt.Errorf("%w '%c'", ErrUnknownSignal, signal),
+		})
+	}
+	return nil, parser.NoChildren
+}
+
+func (b *metaParser) Continue(node gast.Node, reader text.Reader, pc parser.Context) parser.State {
+	b = b.block(pc, node)
+	if b.closed {
+		return parser.Close
+	}
+	line, segment := reader.PeekLine()
+	if n := b.isClose(line); n != -1 && !util.IsBlank(line) {
+		end := b.closeEnd(line, n)
+		b.stop = segment.Start + end
+		segment.Stop -= len(line[n:])
+		node.Lines().Append(segment)
+		reader.Advance(end)
+		b.closed = true
+		return parser.Close
+	}
+	if b.size += segment.Len(); b.MaxBlockSize > 0 && b.size > b.MaxBlockSize {
+		// the rest of the block is left to be parsed as markdown
+		b.large = true
+		return parser.Close
+	}
+	b.track(line)
+	node.Lines().Append(segment)
+	return parser.Continue | parser.NoChildren
+}
+
+// decoder returns the custom decoder registered for the current format.
+func (b *metaParser) decoder() (func([]byte, interface{}) error, bool) {
+	decode, ok := b.Decoders[openSignal(b.format)]
+	return decode, ok
+}
+
+// loadCsv decodes the CSV records in `buf` into metadata, with each record
+// after the header row stored in csvRowsKey as a map of header to field.
+func loadCsv(buf []byte) (metadata, error) {
+	r := csv.NewReader(bytes.NewReader(buf))
+	r.TrimLeadingSpace = true
+	records, err := r.ReadAll()
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	rows := make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(record))
+		for i, field := range record {
+			row[records[0][i]] = field
+		}
+		rows = append(rows, row)
+	}
+	return metadata{csvRowsKey: rows}, nil
+}
+
+// loadCached is like loadMetadata, but uses the Cache when there is one.
+func (b *metaParser) loadCached(buf []byte) (metadata, error) {
+	if b.Cache == nil || b.format == formatAuto {
+		return b.loadMetadata(buf)
+	}
+	h := sha256.New()
+	h.Write([]byte{b.format})
+	h.Write([]byte(b.decodeOptions()))
+	h.Write(buf)
+	key := hex.EncodeToString(h.Sum(nil))
+	if m, ok := b.Cache.Get(key); ok {
+		return deepCopy(metadata(m)).(metadata), nil
+	}
+	m, err := b.loadMetadata(buf)
+	if err == nil {
+		b.Cache.Set(key, deepCopy(m).(metadata))
+	}
+	return m, err
+}
+
+// decodeOptions returns the options that change how loadMetadata decodes
+// or rejects a block, so that blocks decoded with different options are
+// cached under different keys.
+func (b *metaParser) decodeOptions() string {
+	c := b.parserConfig
+	var decode uintptr
+	if fn, ok := b.decoder(); ok {
+		decode = reflect.ValueOf(fn).Pointer()
+	}
+	var known string
+	if c.YAMLKnownFields != nil {
+		known = c.YAMLKnownFields.PkgPath() + "." + c.YAMLKnownFields.String()
+	}
+	return fmt.Sprintf("%t %t %t %d %s %x\n", c.StrictJSON, c.LenientJSON, c.Formats != nil,
+		c.MaxAliasExpansion, known, decode)
+}
+
+// loadMetadata decodes `buf` in the current format.
+// Empty blocks are valid and result in an empty, non-nil metadata.
+func (b *metaParser) loadMetadata(buf []byte) (meta metadata, err error) {
+	if b.LenientJSON && isJson(b.format) {
+		buf = stripJSON(buf)
+	}
+	if util.IsBlank(buf) {
+		return metadata{}, nil
+	} else if b.format == formatAuto {
+		return b.loadDetected(buf)
+	} else if b.StrictJSON && isJson(b.format) {
+		if err = checkDuplicateKeys(buf); err != nil {
+			return meta, err
+		}
+	} else if b.MaxAliasExpansion > 0 && b.format == formatYaml {
+		if aliasExpansion(buf, b.MaxAliasExpansion) > b.MaxAliasExpansion {
+			return meta, fmt.Errorf("meta: yaml aliases expand to more than %d nodes", b.MaxAliasExpansion)
+		}
+	}
+
+	if decode, ok := b.decoder(); ok {
+		err = decode(buf, &meta)
+	} else if b.Formats != nil && b.format == formatJsonClose {
+		if err = json.Unmarshal(buf, &meta); err != nil {
+			err = fmt.Errorf("meta: failed to load metadata: %w", err)
+		}
+	} else if b.format == formatCsv {
+		meta, err = loadCsv(buf)
+	} else if b.format == formatJsonListClose {
+		var list []interface{}
+		if err = dati.LoadData(dati.JSON, bytes.NewReader(buf), &list); err == nil {
+			meta = metadata{jsonListKey: list}
+		} else {
+			err = fmt.Errorf("meta: failed to load JSON list: %w", err)
+		}
+	} else {
+		var format dati.DataFormat
+		switch b.format {
+		case formatYaml:
+			format = dati.YAML
+		case formatToml:
+			format = dati.TOML
+		case formatJsonClose:
+			format = dati.JSON
+		default:
+			return meta, fmt.Errorf("meta: %w", dati.ErrUnsupportedData(string(b.format)))
+		}
+		if err = dati.LoadData(format, bytes.NewReader(buf), &meta); err != nil {
+			err = fmt.Errorf("meta: failed to load metadata: %w", err)
+		} else if format == dati.YAML && b.YAMLKnownFields != nil {
+			err = checkKnownFields(buf, b.YAMLKnownFields)
+		}
+	}
+	if err == nil && meta == nil {
+		meta = metadata{}
+	}
+	return meta, err
+}
+
+// checkKnownFields returns an error if the YAML in `buf` can't be decoded
+// into the struct type `t` with every key matching a field.
+func checkKnownFields(buf []byte, t reflect.Type) error {
+	dec := yaml.NewDecoder(bytes.NewReader(buf))
+	dec.KnownFields(true)
+	if err := dec.Decode(reflect.New(t).Interface()); err != nil && err != io.EOF {
+		return fmt.Errorf("meta: %w", err)
+	}
+	return nil
+}
+
+// stripJSON returns a copy of the JSON in `buf` without comments and
+// trailing commas, see WithLenientJSON.
+func stripJSON(buf []byte) []byte {
+	out := make([]byte, 0, len(buf))
+	comma := -1 // index in out of a comma that may be trailing
+	for i := 0; i < len(buf); i++ {
+		switch c := buf[i]; {
+		case c == '"':
+			j := i + 1
+			for ; j < len(buf) && buf[j] != '"'; j++ {
+				if buf[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(buf) {
+				j = len(buf) - 1
+			}
+			out = append(out, buf[i:j+1]...)
+			i, comma = j, -1
+		case c == '/' && i+1 < len(buf) && buf[i+1] == '/':
+			for i < len(buf) && buf[i] != '\n' {
+				i++
+			}
+			i--
+		case c == '/' && i+1 < len(buf) && buf[i+1] == '*':
+			if end := bytes.Index(buf[i+2:], []byte("*/")); end != -1 {
+				i += end + 3
+			} else {
+				i = len(buf)
+			}
+		case (c == '}' || c == ']') && comma != -1:
+			out = append(out[:comma], out[comma+1:]...)
+			out = append(out, c)
+			comma = -1
+		case c == ',':
+			comma = len(out)
+			out = append(out, c)
+		default:
+			if !util.IsSpace(c) {
+				comma = -1
+			}
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// checkDuplicateKeys returns an error for the first duplicate key found in
+// an object of the JSON in `buf`. Syntax errors are left to the decoder.
+func checkDuplicateKeys(buf []byte) error {
+	type object struct {
+		keys map[string]bool
+		key  bool
+	}
+	var stack []*object // nil for arrays
+	value := func() {
+		if n := len(stack); n > 0 && stack[n-1] != nil {
+			stack[n-1].key = true
+		}
+	}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{':
+				stack = append(stack, &object{keys: make(map[string]bool), key: true})
+			case '[':
+				stack = append(stack, nil)
+			default:
+				stack = stack[:len(stack)-1]
+				value()
+			}
+		case string:
+			if n := len(stack); n > 0 && stack[n-1] != nil && stack[n-1].key {
+				if stack[n-1].keys[t] {
+					return fmt.Errorf("meta: duplicate key %q", t)
+				}
+				stack[n-1].keys[t] = true
+				stack[n-1].key = false
+			} else {
+				value()
+			}
+		default:
+			value()
+		}
+	}
+}
+
+// aliasExpansion returns the number of nodes the aliases in the YAML in
+// `buf` expand to, or `limit`+1 if it's more than `limit`. The YAML is
+// parsed without expanding its aliases, and the size of each anchored value
+// is counted once. YAML that can't be parsed expands to 0 nodes, leaving the
+// error to the decoder.
+func aliasExpansion(buf []byte, limit int) int {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(buf, &doc); err != nil {
+		return 0
+	}
+
+	add := func(a, b int) int {
+		if a+b > limit {
+			return limit + 1
+		}
+		return a + b
+	}
+	sizes := make(map[*yaml.Node]int)
+	var size func(n *yaml.Node) int
+	size = func(n *yaml.Node) int {
+		if n.Kind == yaml.AliasNode {
+			n = n.Alias
+		}
+		if s, ok := sizes[n]; ok {
+			return s
+		}
+		sizes[n] = 0 // recursive
+		s := 1
+		for _, c := range n.Content {
+			s = add(s, size(c))
+		}
+		sizes[n] = s
+		return s
+	}
+
+	total := 0
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		if n.Kind == yaml.AliasNode && n.Alias != nil {
+			total = add(total, size(n.Alias))
+		}
+		for _, c := range n.Content {
+			walk(c)
+		}
+	}
+	walk(&doc)
+	return total
+}
+
+var tomlKeyValue = regexp.MustCompile(`(?m)^\s*[\w."'-]+\s*=`)
+
+// detectFormat returns the format that `buf` appears to be in.
+func detectFormat(buf []byte) byte {
+	buf = util.TrimLeftSpace(buf)
+	switch {
+	case bytes.HasPrefix(buf, []byte{formatJsonOpen}):
+		return formatJsonClose
+	case tomlKeyValue.Match(buf):
+		return formatToml
+	case bytes.HasPrefix(buf, []byte{formatJsonListOpen}):
+		return formatJsonListClose
+	}
+	return formatYaml
+}
+
+// loadDetected decodes `buf` in the format detected by detectFormat, falling
+// back to the other formats, and sets the format of the block to the first
+// that decodes. If none do, the error of the detected format is returned.
+func (b *metaParser) loadDetected(buf []byte) (metadata, error) {
+	detected := detectFormat(buf)
+	b.format = detected
+	meta, err := b.loadMetadata(buf)
+	if err == nil {
+		return meta, nil
+	} else if b.StrictJSON && isJson(detected) && checkDuplicateKeys(buf) != nil {
+		// duplicate keys aren't a reason to try the other formats
+		return meta, err
+	}
+	for _, format := range []byte{formatJsonClose, formatToml, formatYaml} {
+		if format == detected {
+			continue
+		}
+		b.format = format
+		if m, e := b.loadMetadata(buf); e == nil {
+			return m, nil
+		}
+	}
+	b.format = detected
+	return meta, err
+}
+
+// tabIndented returns the line number of the first line in `buf` indented
+// with a tab, or 0 if there are none.
+func tabIndented(buf []byte) int {
+	for i, line := range bytes.Split(buf, []byte("\n")) {
+		indent := line[:len(line)-len(util.TrimLeftSpace(line))]
+		if !util.IsBlank(line) && bytes.IndexByte(indent, '\t') != -1 {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// loadPartial decodes each top-level entry of the YAML in `buf` (a line
+// without indentation and any indented lines after it) separately, returning
+// those that decode without error.
+func (b *metaParser) loadPartial(buf []byte) metadata {
+	meta := metadata{}
+	load := func(chunk []byte) {
+		if m, err := b.loadMetadata(chunk); err == nil {
+			for k, v := range m {
+				meta[k] = v
+			}
+		}
+	}
+	var chunk []byte
+	for _, line := range bytes.SplitAfter(buf, []byte("\n")) {
+		if len(line) > 0 && !util.IsSpace(line[0]) && line[0] != '-' {
+			load(chunk)
+			chunk = nil
+		}
+		chunk = append(chunk, line...)
+	}
+	load(chunk)
+	return meta
+}
+
+// validateSchema validates `m` against `schema`, see WithSchema.
+func validateSchema(schema interface{}, m metadata) error {
+	buf, err := json.Marshal(normalize(m))
+	if err != nil {
+		return err
+	}
+	var v interface{}
+	if err = json.Unmarshal(buf, &v); err != nil {
+		return err
+	}
+	if errs := schemaErrors(schema, v, ""); len(errs) > 0 {
+		return fmt.Errorf("meta: metadata does not match schema: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// schemaType returns the JSON Schema type of the decoded JSON value `v`.
+func schemaType(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if t == float64(int64(t)) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// schemaErrors returns a message for each way the decoded JSON value `v` at
+// `path` doesn't match `schema`.
+func schemaErrors(schema interface{}, v interface{}, path string) (errs []string) {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	at := path
+	if at == "" {
+		at = "/"
+	}
+	number := func(key string) (float64, bool) {
+		n, ok := s[key].(float64)
+		return n, ok
+	}
+
+	if want, ok := s["type"]; ok {
+		types, _ := want.([]interface{})
+		if t, ok := want.(string); ok {
+			types = []interface{}{t}
+		}
+		got, match := schemaType(v), false
+		for _, t := range types {
+			if t == got || (t == "number" && got == "integer") {
+				match = true
+			}
+		}
+		if !match {
+			return append(errs, fmt.Sprintf("%s: expected %v, got %s", at, want, got))
+		}
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		match := false
+		for _, e := range enum {
+			if reflect.DeepEqual(e, v) {
+				match = true
+			}
+		}
+		if !match {
+			errs = append(errs, fmt.Sprintf("%s: %v is not one of %v", at, v, enum))
+		}
+	}
+
+	switch t := v.(type) {
+	case map[string]interface{}:
+		required, _ := s["required"].([]interface{})
+		for _, key := range required {
+			if _, ok := t[fmt.Sprint(key)]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required property %q", at, key))
+			}
+		}
+		properties, _ := s["properties"].(map[string]interface{})
+		keys := make([]string, 0, len(t))
+		for key := range t {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if p, ok := properties[key]; ok {
+				errs = append(errs, schemaErrors(p, t[key], path+"/"+key)...)
+			} else if additional, ok := s["additionalProperties"]; ok {
+				if additional == false {
+					errs = append(errs, fmt.Sprintf("%s: unexpected property %q", at, key))
+				} else {
+					errs = append(errs, schemaErrors(additional, t[key], path+"/"+key)...)
+				}
+			}
+		}
+	case []interface{}:
+		if n, ok := number("minItems"); ok && float64(len(t)) < n {
+			errs = append(errs, fmt.Sprintf("%s: expected at least %v items, got %d", at, n, len(t)))
+		}
+		if n, ok := number("maxItems"); ok && float64(len(t)) > n {
+			errs = append(errs, fmt.Sprintf("%s: expected at most %v items, got %d", at, n, len(t)))
+		}
+		if items, ok := s["items"]; ok {
+			for i, e := range t {
+				errs = append(errs, schemaErrors(items, e, fmt.Sprintf("%s/%d", path, i))...)
+			}
+		}
+	case string:
+		if n, ok := number("minLength"); ok && float64(len([]rune(t))) < n {
+			errs = append(errs, fmt.Sprintf("%s: expected at least %v characters", at, n))
+		}
+		if n, ok := number("maxLength"); ok && float64(len([]rune(t))) > n {
+			errs = append(errs, fmt.Sprintf("%s: expected at most %v characters", at, n))
+		}
+		if pattern, ok := s["pattern"].(string); ok {
+			if re, err := regexp.Compile(pattern); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: invalid pattern %q", at, pattern))
+			} else if !re.MatchString(t) {
+				errs = append(errs, fmt.Sprintf("%s: %q does not match %q", at, t, pattern))
+			}
+		}
+	case float64:
+		if n, ok := number("minimum"); ok && t < n {
+			errs = append(errs, fmt.Sprintf("%s: %v is less than %v", at, t, n))
+		}
+		if n, ok := number("maximum"); ok && t > n {
+			errs = append(errs, fmt.Sprintf("%s: %v is greater than %v", at, t, n))
+		}
+	}
+	return errs
+}
+
+// mapStrings returns `v` with `fn` applied to every string within it,
+// recursing into maps and slices.
+func mapStrings(v interface{}, fn func(string) string) interface{} {
+	switch t := v.(type) {
+	case string:
+		return fn(t)
+	case metadata:
+		for k, e := range t {
+			t[k] = mapStrings(e, fn)
+		}
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = mapStrings(e, fn)
+		}
+	case map[interface{}]interface{}:
+		for k, e := range t {
+			t[k] = mapStrings(e, fn)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = mapStrings(e, fn)
+		}
+	}
+	return v
+}
+
+// dateLayouts are the layouts of strings converted by WithNormalizeDates.
+var dateLayouts = []string{
+	"2006-01-02",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	time.RFC3339,
+	time.RFC3339Nano,
+	"2006-01-02 15:04:05Z07:00",
+}
+
+// parseDates replaces strings in `v` that match one of dateLayouts with the
+// time.Time they represent. Strings without a zone are read in `loc`, or in
+// UTC if `loc` is nil.
+func parseDates(v interface{}, loc *time.Location) interface{} {
+	if loc == nil {
+		loc = time.UTC
+	}
+	switch t := v.(type) {
+	case string:
+		for _, layout := range dateLayouts {
+			if tm, err := time.ParseInLocation(layout, t, loc); err == nil {
+				return tm
+			}
+		}
+	case metadata:
+		for k, e := range t {
+			t[k] = parseDates(e, loc)
+		}
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = parseDates(e, loc)
+		}
+	case map[interface{}]interface{}:
+		for k, e := range t {
+			t[k] = parseDates(e, loc)
+		}
+	case []interface{}:
+		for i, e := range t {
+			t[i] = parseDates(e, loc)
+		}
+	}
+	return v
 }
 
-// TryGet tries to get a metadata.
-// If there are parsing errors, then nil and error are returned
-func TryGet(pc parser.Context) (metadata, error) {
-	dtmp := pc.Get(contextKey)
-	if dtmp == nil {
-		return nil, nil
+// errUnknownType is returned by convertType for types it doesn't support.
+var errUnknownType = errors.New("unknown type")
+
+// convertType returns `v` converted to `typ`, see WithTypes.
+func convertType(v interface{}, typ string) (interface{}, error) {
+	s, isString := v.(string)
+	s = strings.TrimSpace(s)
+	switch typ {
+	case "int":
+		switch t := v.(type) {
+		case int:
+			return t, nil
+		case int64:
+			return int(t), nil
+		case uint64:
+			return int(t), nil
+		case float64:
+			if t == float64(int(t)) {
+				return int(t), nil
+			}
+		case string:
+			if i, err := strconv.Atoi(s); err == nil {
+				return i, nil
+			}
+		}
+	case "float":
+		switch t := v.(type) {
+		case int:
+			return float64(t), nil
+		case int64:
+			return float64(t), nil
+		case uint64:
+			return float64(t), nil
+		case float64:
+			return t, nil
+		case string:
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return f, nil
+			}
+		}
+	case "bool":
+		if b, ok := v.(bool); ok {
+			return b, nil
+		} else if b, err := strconv.ParseBool(s); isString && err == nil {
+			return b, nil
+		}
+	case "string":
+		switch v.(type) {
+		case map[string]interface{}, map[interface{}]interface{}, []interface{}:
+		case nil:
+			return "", nil
+		default:
+			return fmt.Sprint(v), nil
+		}
+	case "[]string":
+		switch t := v.(type) {
+		case []string:
+			return t, nil
+		case []interface{}:
+			list := make([]string, len(t))
+			for i, e := range t {
+				c, err := convertType(e, "string")
+				if err != nil {
+					return nil, err
+				}
+				list[i] = c.(string)
+			}
+			return list, nil
+		case string:
+			return []string{t}, nil
+		}
+	case "time":
+		if t, ok := v.(time.Time); ok {
+			return t, nil
+		} else if t, ok := parseDates(s, nil).(time.Time); isString && ok {
+			return t, nil
+		}
+	default:
+		return nil, fmt.Errorf("%w %q", errUnknownType, typ)
 	}
-	d := dtmp.(*data)
-	if d.Error != nil {
-		return nil, d.Error
+	return nil, fmt.Errorf("cannot convert %v to %s", v, typ)
+}
+
+// applyAliases renames the keys of `m` found in `aliases` to their canonical
+// key, dropping them instead if the canonical key is already set.
+func applyAliases(m metadata, aliases map[string]string, warn func(string, ...interface{})) {
+	names := make([]string, 0, len(aliases))
+	for alias := range aliases {
+		names = append(names, alias)
+	}
+	sort.Strings(names)
+	for _, alias := range names {
+		key := aliases[alias]
+		v, ok := m[alias]
+		if !ok || alias == key {
+			continue
+		}
+		if _, ok = m[key]; !ok {
+			warn("meta: %q is an alias of %q", alias, key)
+			m[key] = v
+		} else {
+			warn("meta: %q is an alias of %q, which is already set", alias, key)
+		}
+		delete(m, alias)
 	}
-	return d.Map, nil
 }
 
-const openToken = "<!--"
-const closeToken = "-->"
-const formatYaml = ':'
-const formatToml = '#'
-const formatJsonOpen = '{'
-const formatJsonClose = '}'
+// depth returns the number of levels of maps and lists in `v`.
+func depth(v interface{}) int {
+	n := 0
+	switch t := v.(type) {
+	case metadata:
+		return depth(map[string]interface{}(t))
+	case map[string]interface{}:
+		for _, e := range t {
+			if d := depth(e); d > n {
+				n = d
+			}
+		}
+	case map[interface{}]interface{}:
+		for _, e := range t {
+			if d := depth(e); d > n {
+				n = d
+			}
+		}
+	case []interface{}:
+		for _, e := range t {
+			if d := depth(e); d > n {
+				n = d
+			}
+		}
+	default:
+		return 0
+	}
+	return n + 1
+}
 
-type metaParser struct {
-	format byte
+// mergeMeta sets the values of `src` in `dst`, merging maps present in both.
+func mergeMeta(dst, src map[string]interface{}) {
+	for k, v := range src {
+		d, dok := dst[k].(map[string]interface{})
+		s, sok := v.(map[string]interface{})
+		if dok && sok {
+			mergeMeta(d, s)
+		} else {
+			dst[k] = v
+		}
+	}
 }
 
-var defaultParser = &metaParser{}
+// interpolateKeys replaces ${Key} in the top-level string values of `m` with
+// the top-level string value of Key, references to other keys are left as-is.
+func interpolateKeys(m metadata) error {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 
-// NewParser returns a BlockParser that can parse metadata blocks.
-func NewParser() parser.BlockParser {
-	return defaultParser
+	done := make(map[string]bool, len(m))
+	pending := make(map[string]bool)
+	var resolve func(key string) error
+	resolve = func(key string) error {
+		s, ok := m[key].(string)
+		if !ok || done[key] {
+			return nil
+		} else if pending[key] {
+			return fmt.Errorf("meta: circular reference to key %q", key)
+		}
+		pending[key] = true
+		var buf strings.Builder
+		for {
+			i := strings.Index(s, "${")
+			if i == -1 {
+				break
+			}
+			j := strings.IndexByte(s[i:], '}')
+			if j == -1 {
+				break
+			}
+			ref := s[i+2 : i+j]
+			if _, ok := m[ref].(string); ok {
+				if err := resolve(ref); err != nil {
+					return err
+				}
+				buf.WriteString(s[:i])
+				buf.WriteString(m[ref].(string))
+			} else {
+				buf.WriteString(s[:i+j+1])
+			}
+			s = s[i+j+1:]
+		}
+		buf.WriteString(s)
+		m[key] = buf.String()
+		delete(pending, key)
+		done[key] = true
+		return nil
+	}
+	for _, k := range keys {
+		if err := resolve(k); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func isOpen(line []byte) bool {
-	line = util.TrimRightSpace(util.TrimLeftSpace(line))
-	for i := 0; i < len(line); i++ {
-		if len(line[i:]) >= len(openToken)+1 && line[i] == openToken[0] {
-			signal := line[i+len(openToken)]
-			switch signal {
-			case formatYaml:
-				fallthrough
-			case formatToml:
-				fallthrough
-			case formatJsonOpen:
-				return true
-			default:
-				break
+// yamlSpans returns the spans of the top-level keys in the YAML `lines` of
+// `source`, found like scanKeys does.
+func yamlSpans(source []byte, lines *text.Segments) map[string][2]int {
+	spans := make(map[string][2]int)
+	key := ""
+	for i := 0; i < lines.Len(); i++ {
+		segment := lines.At(i)
+		line := segment.Value(source)
+		if util.IsBlank(line) || line[0] == '#' {
+			continue
+		} else if !util.IsSpace(line[0]) && bytes.IndexByte([]byte("-.[{"), line[0]) == -1 {
+			if n := bytes.IndexByte(line, ':'); n > 0 {
+				key = strings.Trim(string(line[:n]), `"' `)
+				spans[key] = [2]int{segment.Start, segment.Start}
 			}
 		}
+		if span, ok := spans[key]; ok {
+			span[1] = segment.Start + len(util.TrimRightSpace(line))
+			spans[key] = span
+		}
 	}
-	return false
+	return spans
 }
 
-// isClose will check `line` for the closing token.
-// If found, the integer returned will be the *nth* byte of `line` that the close token starts at.
-// If not found, then -1 is returned.
-func isClose(line []byte, signal byte) int {
-	//line = util.TrimRightSpace(util.TrimLeftSpace(line))
-	for i := 0; i < len(line); i++ {
-		if line[i] == signal && len(line[i:]) >= len(closeToken)+1 {
-			i++
-			if string(line[i:i+len(closeToken)]) == closeToken {
-				if signal == formatJsonClose {
-					return i
-				} else {
-					return i - 1
-				}
+// scanKeys returns the top-level keys of `buf` in the order they appear,
+// as best it can without fully decoding `buf`.
+func scanKeys(format byte, buf []byte) (keys []string) {
+	switch format {
+	case formatJsonClose:
+		dec := json.NewDecoder(bytes.NewReader(buf))
+		if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+			return nil
+		}
+		for dec.More() {
+			t, err := dec.Token()
+			if err != nil {
+				break
+			}
+			key, _ := t.(string)
+			keys = append(keys, key)
+			var skip json.RawMessage
+			if err = dec.Decode(&skip); err != nil {
+				break
+			}
+		}
+	case formatYaml:
+		for _, line := range bytes.Split(buf, []byte("\n")) {
+			if len(line) == 0 || util.IsSpace(line[0]) || bytes.IndexByte([]byte("#-.[{"), line[0]) != -1 {
+				continue
+			}
+			if i := bytes.IndexByte(line, ':'); i > 0 {
+				keys = append(keys, strings.Trim(string(line[:i]), `"' `))
+			}
+		}
+	case formatToml:
+		table := false
+		for _, line := range bytes.Split(buf, []byte("\n")) {
+			line = util.TrimLeftSpace(line)
+			if len(line) == 0 || line[0] == '#' {
+				continue
+			} else if line[0] == '[' {
+				table = true
+				name := strings.Trim(string(line), "[] \t\r")
+				keys = append(keys, strings.Trim(strings.SplitN(name, ".", 2)[0], `"' `))
+			} else if i := bytes.IndexByte(line, '='); i > 0 && !table {
+				name := string(line[:i])
+				keys = append(keys, strings.Trim(strings.SplitN(name, ".", 2)[0], `"' `))
 			}
 		}
 	}
-	return -1
+	return keys
 }
 
-func (b *metaParser) Trigger() []byte {
-	return []byte{openToken[0]}
+// keyOrder is the order of the keys in a YAML mapping and its nested mappings.
+type keyOrder struct {
+	keys []string
+	sub  map[string]*keyOrder
 }
 
-func (b *metaParser) Open(parent gast.Node, reader text.Reader, pc parser.Context) (gast.Node, parser.State) {
-	if linenum, _ := reader.Position(); linenum != 0 {
-		return nil, parser.NoChildren
+// yamlOrder returns the order of the keys in the mappings in `n`, or nil if
+// it has none. Nodes shared by aliases are only visited once.
+func yamlOrder(n *yaml.Node, seen map[*yaml.Node]*keyOrder) *keyOrder {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
 	}
-	line, _ := reader.PeekLine()
-
-	if isOpen(line) {
-		reader.Advance(len(openToken))
-		if b.format = reader.Peek(); b.format == formatJsonOpen {
-			b.format = formatJsonClose
-		} else {
-			reader.Advance(1)
+	if o, ok := seen[n]; ok {
+		return o
+	}
+	seen[n] = nil // recursive
+	var o *keyOrder
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) > 0 {
+			o = yamlOrder(n.Content[0], seen)
+		}
+	case yaml.MappingNode:
+		o = &keyOrder{sub: make(map[string]*keyOrder)}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k := n.Content[i].Value
+			o.keys = append(o.keys, k)
+			if sub := yamlOrder(n.Content[i+1], seen); sub != nil {
+				o.sub[k] = sub
+			}
+		}
+	case yaml.SequenceNode:
+		for i, c := range n.Content {
+			if sub := yamlOrder(c, seen); sub != nil {
+				if o == nil {
+					o = &keyOrder{sub: make(map[string]*keyOrder)}
+				}
+				o.sub[strconv.Itoa(i)] = sub
+			}
 		}
+	}
+	seen[n] = o
+	return o
+}
 
-		node := gast.NewTextBlock()
-		if b.Continue(node, reader, pc) != parser.Close {
-			return node, parser.NoChildren
+// apply returns `v` with the maps in it converted to a MapSlice in the
+// order of `o`. Keys that aren't in `o` follow in sorted order.
+func (o *keyOrder) apply(v interface{}) interface{} {
+	sub := func(k string) *keyOrder {
+		if o == nil {
+			return nil
 		}
-		parent.AppendChild(parent, node)
-		b.Close(node, reader, pc)
+		return o.sub[k]
 	}
-	return nil, parser.NoChildren
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return o.apply(metadata(v))
+	case metadata:
+		var keys []string
+		if o != nil {
+			keys = o.keys
+		}
+		s := make(MapSlice, 0, len(v))
+		for _, k := range orderKeys(v, keys) {
+			s = append(s, KV{Key: k, Value: sub(k).apply(v[k])})
+		}
+		return s
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i := range v {
+			l[i] = sub(strconv.Itoa(i)).apply(v[i])
+		}
+		return l
+	}
+	return v
 }
 
-func (b *metaParser) Continue(node gast.Node, reader text.Reader, pc parser.Context) parser.State {
-	line, segment := reader.PeekLine()
-	if n := isClose(line, b.format); n != -1 && !util.IsBlank(line) {
-		segment.Stop -= len(line[n:])
-		node.Lines().Append(segment)
-		reader.Advance(n + len(closeToken) + 1)
-		return parser.Close
+// orderKeys returns the keys of `m`, in the order of `scanned` where they're
+// found in it, followed by the remaining keys sorted.
+func orderKeys(m metadata, scanned []string) []string {
+	keys := make([]string, 0, len(m))
+	seen := make(map[string]bool, len(m))
+	for _, k := range scanned {
+		if _, ok := m[k]; ok && !seen[k] {
+			keys = append(keys, k)
+			seen[k] = true
+		}
 	}
-	node.Lines().Append(segment)
-	return parser.Continue | parser.NoChildren
+	rest := make([]string, 0, len(m)-len(keys))
+	for k := range m {
+		if !seen[k] {
+			rest = append(rest, k)
+		}
+	}
+	sort.Strings(rest)
+	return append(keys, rest...)
 }
 
-func (b *metaParser) loadMetadata(buf []byte) (meta metadata, err error) {
-	var format dati.DataFormat
-	switch b.format {
-	case formatYaml:
-		format = dati.YAML
-	case formatToml:
-		format = dati.TOML
-	case formatJsonClose:
-		format = dati.JSON
-	default:
-		return meta, dati.ErrUnsupportedData(string(b.format))
+// process applies the configured transformations and validators to the
+// metadata decoded from `block` into `d`.
+func (b *metaParser) process(d *data, block []byte) error {
+	if b.RejectEmpty && len(d.Map) == 0 {
+		return ErrEmptyMetadata
 	}
-	err = dati.LoadData(format, bytes.NewReader(buf), &meta)
-	return meta, err
+	if n := depth(d.Map); b.MaxDepth > 0 && n > b.MaxDepth {
+		return fmt.Errorf("meta: metadata is nested %d levels deep, more than %d", n, b.MaxDepth)
+	}
+	if b.KeyAliases != nil {
+		applyAliases(d.Map, b.KeyAliases, b.warn)
+	}
+	if b.KeyStyleError != nil {
+		return b.KeyStyleError
+	} else if b.KeyStyle != nil {
+		if err := applyKeyStyle(d.Map, b.KeyStyle); err != nil {
+			return err
+		}
+	}
+	if b.Environment != "" {
+		// normalized so that YAML maps with non-string keys are merged
+		d.Map = metadata(normalize(d.Map).(map[string]interface{}))
+		env, _ := d.Map[b.Environment].(map[string]interface{})
+		for _, name := range b.Environments {
+			delete(d.Map, name)
+		}
+		mergeMeta(d.Map, env)
+	}
+	if b.BaseMetadata != nil {
+		// normalized so that nested YAML maps are merged
+		m := normalize(deepCopy(b.BaseMetadata)).(map[string]interface{})
+		mergeMeta(m, normalize(d.Map).(map[string]interface{}))
+		d.Map = m
+	}
+	if b.InterpolateKeys {
+		if err := interpolateKeys(d.Map); err != nil {
+			return err
+		}
+	}
+	if b.EnvLookup != nil {
+		lookup := b.EnvLookup
+		mapStrings(d.Map, func(s string) string {
+			return os.Expand(s, lookup)
+		})
+	}
+	if b.FileReferences != nil {
+		var err error
+		mapStrings(d.Map, func(s string) string {
+			if !strings.HasPrefix(s, fileReferencePrefix) || err != nil {
+				return s
+			}
+			buf, e := fs.ReadFile(b.FileReferences, strings.TrimPrefix(s, fileReferencePrefix))
+			if e != nil {
+				err = fmt.Errorf("meta: %w", e)
+			}
+			return string(buf)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if b.NormalizeDates {
+		parseDates(d.Map, b.Location)
+	}
+	for k, typ := range b.Types {
+		if v, ok := d.Map[k]; ok {
+			c, err := convertType(v, typ)
+			if err != nil {
+				return fmt.Errorf("meta: %s: %w", k, err)
+			}
+			d.Map[k] = c
+		}
+	}
+	if b.DeriveSlug != nil {
+		_, ok := d.Map["Slug"]
+		if _, lower := d.Map["slug"]; !ok && !lower {
+			if slug := b.DeriveSlug(d.Map); slug != "" {
+				d.Map["Slug"] = slug
+			}
+		}
+	}
+	if b.OrderedKeys || (b.YAMLMapSlice && b.format == formatYaml) {
+		var scanned []string
+		var order *keyOrder
+		if _, ok := b.decoder(); !ok {
+			scanned = scanKeys(b.format, block)
+			var doc yaml.Node
+			if b.YAMLMapSlice && b.format == formatYaml && yaml.Unmarshal(block, &doc) == nil {
+				order = yamlOrder(&doc, make(map[*yaml.Node]*keyOrder))
+			}
+		}
+		if order != nil {
+			d.Order = &keyOrder{sub: make(map[string]*keyOrder)}
+		}
+		for i, k := range scanned {
+			if key, ok := b.KeyAliases[k]; ok {
+				scanned[i] = key
+			}
+			if key := scanned[i]; b.KeyStyle != nil && b.KeyStyle(key) != "" {
+				scanned[i] = b.KeyStyle(key)
+			}
+			if d.Order != nil && order.sub[k] != nil {
+				d.Order.sub[scanned[i]] = order.sub[k]
+			}
+		}
+		d.Keys = orderKeys(d.Map, scanned)
+	}
+	if b.AllowedKeys != nil {
+		var unknown []string
+		for k := range d.Map {
+			if !b.AllowedKeys[k] && k != csvRowsKey && k != jsonListKey {
+				unknown = append(unknown, k)
+			}
+		}
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			return fmt.Errorf("meta: unknown keys: %s", strings.Join(unknown, ", "))
+		}
+	}
+	if b.Enums != nil {
+		if err := checkEnums(d.Map, b.Enums); err != nil {
+			return err
+		}
+	}
+	if b.SchemaError != nil {
+		return fmt.Errorf("meta: invalid schema: %w", b.SchemaError)
+	} else if b.Schema != nil {
+		if err := validateSchema(b.Schema, d.Map); err != nil {
+			return err
+		}
+	}
+	for _, validate := range b.Validators {
+		if err := validate(d.Map); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
 }
 
 func (b *metaParser) Close(node gast.Node, reader text.Reader, pc parser.Context) {
+	b = b.block(pc, node)
+	if b.unmatched && b.closed {
+		node.Parent().RemoveChild(node.Parent(), node)
+		return
+	}
 	lines := node.Lines()
-	var buf bytes.Buffer
+	buf := bufferPool.Get().(*bytes.Buffer)
+	defer bufferPool.Put(buf)
+	buf.Reset()
 	for i := 0; i < lines.Len(); i++ {
 		segment := lines.At(i)
 		buf.Write(segment.Value(reader.Source()))
 	}
-	d := &data{Node: node}
-	d.Map, d.Error = b.loadMetadata(buf.Bytes())
+	d := &data{Node: node, Source: reader.Source(), Config: b.parserConfig}
+	d.Start, d.Stop = b.start, b.stop
+	if !b.closed && lines.Len() > 0 {
+		d.Stop = lines.At(lines.Len() - 1).Stop
+	}
+	b.decode(d, buf.Bytes())
+	if d.Error == nil && b.KeySpans && b.format == formatYaml {
+		d.Spans = yamlSpans(d.Source, lines)
+	}
+	if prev, ok := pc.Get(contextKey).(*data); ok && b.MultipleBlocks && prev.Node != nil && !prev.transformed &&
+		sameSource(prev.Source, d.Source) && prev.Stop <= d.Start {
+		d.merge(prev)
+	}
 
 	pc.Set(contextKey, d)
+	for _, key := range b.CompatKeys {
+		if d.Error == nil {
+			pc.Set(key, map[string]interface{}(d.Map))
+		} else {
+			pc.Set(key, nil)
+		}
+	}
+	if d.Error == nil && b.OnParsed != nil {
+		b.OnParsed(d.Map)
+	}
 
-	if d.Error == nil {
+	if d.Error == nil && (b.PreserveComment || b.Placeholder != "") {
+		// rendered verbatim by the transformer
+		node.SetLines(text.NewSegments())
+	} else if d.Error == nil {
 		node.Parent().RemoveChild(node.Parent(), node)
 	}
 }
 
+// decode sets the metadata of `d` and any error from the contents of the
+// block, `buf`.
+func (b *metaParser) decode(d *data, buf []byte) {
+	block := b.unescapeClose(util.TrimRightSpace(buf))
+	if b.large {
+		d.Error = fmt.Errorf("meta: metadata block exceeds %d bytes", b.MaxBlockSize)
+	} else if !b.closed && !b.ImplicitClose {
+		d.Error = errors.New("meta: metadata block is missing its close token")
+	} else if d.Map, d.Error = b.loadCached(block); d.Error == nil {
+		d.Error = b.process(d, block)
+	} else if b.format == formatYaml {
+		if n := tabIndented(block); n != 0 {
+			n += bytes.Count(d.Source[:d.Start], []byte("\n"))
+			d.Error = fmt.Errorf("%w; yaml uses tab indentation at line %d", d.Error, n)
+		}
+		if b.BestEffort {
+			d.Map = b.loadPartial(block)
+		}
+	}
+}
+
 func (b *metaParser) CanInterruptParagraph() bool {
-	return true
+	return b.InterruptParagraph
 }
 
 func (b *metaParser) CanAcceptIndentedLine() bool {
@@ -196,6 +3991,12 @@ type astTransformer struct {
 type transformerConfig struct {
 	// Stores metadata in ast.Document.Meta().
 	StoresInDocument bool
+	// Prefixes keys stored in ast.Document.Meta().
+	MetaPrefix string
+	// Key the whole metadata is stored under in ast.Document.Meta().
+	StoreUnderKey string
+	// Treats a document without a metadata block as a parsing error.
+	MandatoryBlock bool
 }
 
 type transformerOption interface {
@@ -218,6 +4019,67 @@ func WithStoresInDocument() Option {
 	}
 }
 
+var _ transformerOption = &withMandatoryBlock{}
+
+type withMandatoryBlock struct {
+	value bool
+}
+
+// WithMandatoryBlock is a functional option that treats a document without a
+// metadata block as a parsing error, wrapping ErrNoMetadata.
+func WithMandatoryBlock() Option {
+	return &withMandatoryBlock{
+		value: true,
+	}
+}
+
+func (o *withMandatoryBlock) metaOption() {}
+
+func (o *withMandatoryBlock) SetMetaOption(c *transformerConfig) {
+	c.MandatoryBlock = o.value
+}
+
+var _ transformerOption = &withMetaPrefix{}
+
+type withMetaPrefix struct {
+	value string
+}
+
+// WithMetaPrefix is a functional option that prefixes the keys stored in
+// ast.Document.Meta() by WithStoresInDocument with `prefix`.
+func WithMetaPrefix(prefix string) Option {
+	return &withMetaPrefix{
+		value: prefix,
+	}
+}
+
+func (o *withMetaPrefix) metaOption() {}
+
+func (o *withMetaPrefix) SetMetaOption(c *transformerConfig) {
+	c.MetaPrefix = o.value
+}
+
+var _ transformerOption = &withStoreUnderKey{}
+
+type withStoreUnderKey struct {
+	value string
+}
+
+// WithStoreUnderKey is a functional option that stores the whole metadata,
+// as a map[string]interface{}, under `key` in ast.Document.Meta(). It can be
+// used instead of WithStoresInDocument, or with it to store both.
+func WithStoreUnderKey(key string) Option {
+	return &withStoreUnderKey{
+		value: key,
+	}
+}
+
+func (o *withStoreUnderKey) metaOption() {}
+
+func (o *withStoreUnderKey) SetMetaOption(c *transformerConfig) {
+	c.StoreUnderKey = o.value
+}
+
 func newTransformer(opts ...transformerOption) parser.ASTTransformer {
 	p := &astTransformer{
 		transformerConfig: transformerConfig{
@@ -230,24 +4092,64 @@ func newTransformer(opts ...transformerOption) parser.ASTTransformer {
 	return p
 }
 
+// sameSource reports whether `a` and `b` are the same slice.
+func sameSource(a, b []byte) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
 func (a *astTransformer) Transform(node *gast.Document, reader text.Reader, pc parser.Context) {
-	dtmp := pc.Get(contextKey)
-	if dtmp == nil {
+	d, _ := pc.Get(contextKey).(*data)
+	if d != nil && (d.transformed || !sameSource(d.Source, reader.Source())) {
+		// left in a reused context by a previous document
+		Clear(pc)
+		d = nil
+	}
+	pc.Set(blockKey, nil)
+	pc.Set(prevBlockKey, nil)
+	if d == nil {
+		if a.MandatoryBlock {
+			pc.Set(contextKey, &data{
+				Source:      reader.Source(),
+				Error:       fmt.Errorf("%w: a metadata block is required", ErrNoMetadata),
+				transformed: true,
+			})
+		}
 		return
 	}
-	d := dtmp.(*data)
+	d.transformed = true
 	if d.Error != nil {
-		msg := gast.NewString([]byte(fmt.Sprintf("<!-- meta error, %s -->", d.Error)))
-		msg.SetCode(true)
-		d.Node.AppendChild(d.Node, msg)
+		if d.Node != nil {
+			msg := gast.NewString([]byte(fmt.Sprintf("<!-- meta error, %s -->", d.Error)))
+			msg.SetCode(true)
+			d.Node.AppendChild(d.Node, msg)
+		}
 		return
 	}
+	if d.Config.skipsFirstLine(d.Source) && d.Start == bytes.IndexByte(d.Source, '\n')+1 {
+		if p, ok := node.FirstChild().(*gast.Paragraph); ok && p.Lines().Len() == 1 && p.Lines().At(0).Start == 0 {
+			node.RemoveChild(node, p)
+		}
+	}
+	if d.Config.Placeholder != "" {
+		placeholder := gast.NewString([]byte(d.Config.Placeholder))
+		placeholder.SetCode(true)
+		d.Node.AppendChild(d.Node, placeholder)
+	} else if d.Config.PreserveComment {
+		comment := gast.NewString(d.Source[d.Start:d.Stop])
+		comment.SetCode(true)
+		d.Node.AppendChild(d.Node, comment)
+	}
 
+	node.SetAttribute(rendererAttribute, d.Map)
 	if a.StoresInDocument {
+		// normalized so that node.Meta() can always be marshalled to JSON
 		for k, v := range d.Map {
-			node.AddMeta(k, v)
+			node.AddMeta(a.MetaPrefix+k, normalize(v))
 		}
 	}
+	if a.StoreUnderKey != "" {
+		node.AddMeta(a.StoreUnderKey, normalize(d.Map))
+	}
 }
 
 // Option interface sets options for this extension.
@@ -261,6 +4163,24 @@ func (o *withStoresInDocument) SetMetaOption(c *transformerConfig) {
 	c.StoresInDocument = o.value
 }
 
+var _ Option = &withPriority{}
+
+type withPriority struct {
+	value int
+}
+
+// WithPriority is a functional option that sets the priority the metadata
+// parser is registered with by Extend (default 0). Lower values run first, so
+// use this to order the parser relative to other block parsers, such as
+// another front matter extension.
+func WithPriority(n int) Option {
+	return &withPriority{
+		value: n,
+	}
+}
+
+func (o *withPriority) metaOption() {}
+
 type meta struct {
 	options []Option
 }
@@ -276,17 +4196,81 @@ func New(opts ...Option) goldmark.Extender {
 	return e
 }
 
+// NewWithError is like New, but returns an error if any of `opts` are
+// invalid or conflict with each other.
+func NewWithError(opts ...Option) (goldmark.Extender, error) {
+	if err := validateOptions(opts); err != nil {
+		return nil, err
+	}
+	return New(opts...), nil
+}
+
+func validateOptions(opts []Option) error {
+	decoders := make(map[byte]bool)
+	for _, opt := range opts {
+		switch o := opt.(type) {
+		case *withTokens:
+			if len(o.open) == 0 || len(o.close) == 0 {
+				return fmt.Errorf("meta: open and close tokens must not be empty")
+			}
+		case *withSchema:
+			var schema interface{}
+			err := json.Unmarshal(o.value, &schema)
+			if err == nil {
+				err = checkSchema(schema, "")
+			}
+			if err != nil {
+				return fmt.Errorf("meta: invalid schema: %w", err)
+			}
+		case *withTypes:
+			for k, typ := range o.value {
+				if _, err := convertType(nil, typ); errors.Is(err, errUnknownType) {
+					return fmt.Errorf("meta: %s: %w", k, err)
+				}
+			}
+		case *withFormats:
+			for _, name := range o.value {
+				if _, ok := formatNames[strings.ToLower(name)]; !ok {
+					return fmt.Errorf("meta: %w", dati.ErrUnsupportedData(name))
+				}
+			}
+		case *withKeyStyle:
+			if _, ok := keyStyles[strings.ToLower(o.value)]; !ok {
+				return fmt.Errorf("meta: unknown key style %q", o.value)
+			}
+		case *withYAMLKnownFields:
+			if o.value == nil || o.value.Kind() != reflect.Struct {
+				return fmt.Errorf("meta: YAML known fields must be a struct, not %v", o.value)
+			}
+		case *withDecoder:
+			if decoders[o.signal] {
+				return fmt.Errorf("meta: multiple decoders registered for signal '%c'", o.signal)
+			}
+			decoders[o.signal] = true
+		}
+	}
+	return nil
+}
+
 // Extend implements goldmark.Extender.
 func (e *meta) Extend(m goldmark.Markdown) {
+	popts := []parserOption{}
 	topts := []transformerOption{}
+	priority := 0
 	for _, opt := range e.options {
+		if o, ok := opt.(*withPriority); ok {
+			priority = o.value
+		}
+		if popt, ok := opt.(parserOption); ok {
+			popts = append(popts, popt)
+		}
 		if topt, ok := opt.(transformerOption); ok {
 			topts = append(topts, topt)
 		}
 	}
 	m.Parser().AddOptions(
 		parser.WithBlockParsers(
-			util.Prioritized(NewParser(), 0),
+			util.Prioritized(newParser(popts...), priority),
 		),
 	)
 	m.Parser().AddOptions(
@@ -0,0 +1,53 @@
+//go:build go1.18
+// +build go1.18
+
+package meta
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/parser"
+)
+
+func FuzzMetaExtraction(f *testing.F) {
+	for _, format := range testMetaFormats {
+		f.Add([]byte(validSource[format]))
+		f.Add([]byte(invalidSource[format]))
+	}
+	f.Add([]byte("<!--:\n:-->"))
+	f.Add([]byte("<!--{}-->"))
+	f.Add([]byte("<!--# -->\n"))
+	f.Add([]byte("<!--:\nTitle: -->\n:-->\n"))
+	f.Add([]byte("Markdown without metadata\n"))
+
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithStoresInDocument())))
+	f.Fuzz(func(t *testing.T, source []byte) {
+		if err := markdown.Convert(source, io.Discard, parser.WithContext(parser.NewContext())); err != nil {
+			t.Fatal(err)
+		}
+
+		m, body, err := ExtractMeta(source)
+		if m == nil || err != nil {
+			return
+		}
+		// re-embed the extracted block in front of a new body
+		block := append([]byte{}, source[:len(source)-len(body)]...)
+		if !bytes.HasSuffix(block, []byte("\n")) {
+			block = append(block, '\n')
+		}
+		remeta, rebody, err := ExtractMeta(append(block, "Markdown with metadata\n"...))
+		if err != nil {
+			t.Fatalf("re-extracting %q failed: %s", block, err)
+		}
+		if !reflect.DeepEqual(m, remeta) {
+			t.Errorf("re-extracting %q should return %v, got %v", block, m, remeta)
+		}
+		if string(rebody) != "Markdown with metadata\n" {
+			t.Errorf("re-extracting %q should return the new body, got %q", block, rebody)
+		}
+	})
+}
@@ -1,12 +1,31 @@
 package meta
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/yuin/goldmark"
+	gast "github.com/yuin/goldmark/ast"
 	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/renderer"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+	"gopkg.in/yaml.v3"
+	"notabug.org/gearsix/dati"
 )
 
 var testMetaFormats = []string{"yaml", "json", "toml"}
@@ -50,8 +69,20 @@ Markdown with metadata
 `,
 }
 
+// convert converts `src` with `markdown`, returning its parser.Context and
+// the rendered HTML.
+func convert(t *testing.T, markdown goldmark.Markdown, src string) (parser.Context, string) {
+	t.Helper()
+	context := parser.NewContext()
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(src), &buf, parser.WithContext(context)); err != nil {
+		t.Fatal(err)
+	}
+	return context, buf.String()
+}
+
 func TestMeta(t *testing.T) {
-	markdown := goldmark.New(goldmark.WithExtensions(MetaMarkdown))
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
 	context := parser.NewContext()
 
 	for _, format := range testMetaFormats {
@@ -86,7 +117,7 @@ func TestMeta(t *testing.T) {
 }
 
 func TestMeta_Error(t *testing.T) {
-	markdown := goldmark.New(goldmark.WithExtensions(MetaMarkdown))
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
 	context := parser.NewContext()
 
 	var buf bytes.Buffer
@@ -102,3 +133,2762 @@ func TestMeta_Error(t *testing.T) {
 		buf.Reset()
 	}
 }
+
+func TestMeta_ErrorWrapping(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	for _, format := range testMetaFormats {
+		context, out := convert(t, markdown, invalidSource[format])
+		_, err := TryGet(context)
+		if err == nil || errors.Unwrap(err) == nil {
+			t.Errorf("%s: the dati error must be wrapped, but got %v", format, err)
+		} else if strings.Count(err.Error(), "meta:") != 1 {
+			t.Errorf("%s: the error should only be wrapped once, but got %q", format, err)
+		} else if !strings.Contains(out, err.Error()) {
+			t.Errorf("%s: the error comment should contain %q, but got %q", format, err, out)
+		}
+	}
+
+	context, _ := convert(t, markdown, validSource["yaml"])
+	err := RenderMeta(context, "xml", io.Discard)
+	var unsupported dati.ErrUnsupportedData
+	if !errors.As(err, &unsupported) {
+		t.Errorf("an unknown format should wrap dati.ErrUnsupportedData, but got %v", err)
+	}
+}
+
+func TestMeta_TrailingBlankLines(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := "<!--:\nTitle: mmd\nTags:\n  - markdown\n\n  \n\t\n\n:-->\n\nMarkdown with metadata\n"
+
+	context, out := convert(t, markdown, source)
+	metaData, err := TryGet(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metaData["Title"] != "mmd" {
+		t.Errorf("Title must be 'mmd', but got %v", metaData["Title"])
+	}
+	if out != "<p>Markdown with metadata</p>\n" {
+		t.Errorf("should render '<p>Markdown with metadata</p>', but '%s'", out)
+	}
+
+	context, _ = convert(t, markdown, "<!--:\nMood: happy :-\n\n:-->\n")
+	if mood := Get(context)["Mood"]; mood != "happy :-" {
+		t.Errorf("Mood must be 'happy :-', but got %v", mood)
+	}
+	context, _ = convert(t, markdown, "<!--{ \"Mood\": \"happy }-\" }-->\n")
+	if mood := Get(context)["Mood"]; mood != "happy }-" {
+		t.Errorf("Mood must be 'happy }-', but got %v", mood)
+	}
+}
+
+func TestMustGet(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+
+	context, _ := convert(t, markdown, validSource["yaml"])
+	if title := MustGet(context)["Title"]; title != "mmd" {
+		t.Errorf("Title must be 'mmd', but got %v", title)
+	}
+}
+
+func TestMustGet_Panic(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+
+	context, _ := convert(t, markdown, invalidSource["json"])
+	_, err := TryGet(context)
+	if err == nil {
+		t.Fatal("expected a parse error")
+	}
+
+	defer func() {
+		r := recover()
+		if r == nil {
+			t.Fatal("MustGet should panic on a parse error")
+		}
+		if msg, ok := r.(string); !ok || !strings.Contains(msg, err.Error()) {
+			t.Errorf("panic message should contain '%s', but got '%v'", err, r)
+		}
+	}()
+	MustGet(context)
+}
+
+func TestMeta_EnvExpansion(t *testing.T) {
+	t.Setenv("MMD_BASE_URL", "https://example.com")
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithEnvExpansion())))
+	source := `<!--:
+baseurl: ${MMD_BASE_URL}/blog
+feed: $MMD_BASE_URL/feed.xml
+missing: "${MMD_NOT_SET}"
+draft: true
+weight: 3
+Tags:
+  - $MMD_BASE_URL
+:-->
+`
+
+	context, _ := convert(t, markdown, source)
+	metaData, err := TryGet(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metaData["baseurl"] != "https://example.com/blog" {
+		t.Errorf("baseurl must be expanded, but got %v", metaData["baseurl"])
+	}
+	if metaData["feed"] != "https://example.com/feed.xml" {
+		t.Errorf("feed must be expanded, but got %v", metaData["feed"])
+	}
+	if metaData["missing"] != "" {
+		t.Errorf("missing must expand to an empty string, but got %v", metaData["missing"])
+	}
+	if metaData["draft"] != true {
+		t.Errorf("draft must be left untouched, but got %v", metaData["draft"])
+	}
+	if tags, ok := metaData["Tags"].([]interface{}); !ok || len(tags) != 1 || tags[0] != "https://example.com" {
+		t.Errorf("Tags must be expanded, but got %v", metaData["Tags"])
+	}
+}
+
+func TestMeta_EnvLookup(t *testing.T) {
+	lookup := func(key string) string {
+		if key == "BASE_URL" {
+			return "https://example.org"
+		}
+		return ""
+	}
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithEnvLookup(lookup))))
+	source := `<!--{ "baseurl": "${BASE_URL}", "weight": 3 }-->
+Markdown with metadata`
+
+	context, _ := convert(t, markdown, source)
+	metaData := Get(context)
+	if metaData["baseurl"] != "https://example.org" {
+		t.Errorf("baseurl must be expanded, but got %v", metaData["baseurl"])
+	}
+	if metaData["weight"] != float64(3) {
+		t.Errorf("weight must be left untouched, but got %v", metaData["weight"])
+	}
+}
+
+func decodeJSONC(buf []byte, v interface{}) error {
+	var stripped bytes.Buffer
+	for _, line := range bytes.Split(buf, []byte("\n")) {
+		if i := bytes.Index(line, []byte("//")); i != -1 {
+			line = line[:i]
+		}
+		stripped.Write(line)
+		stripped.WriteByte('\n')
+	}
+	return json.Unmarshal(stripped.Bytes(), v)
+}
+
+func TestMeta_WithDecoder(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithDecoder('{', decodeJSONC))))
+	source := `<!--{
+	// the document title
+	"Title": "mmd",
+	"Tags": [ "markdown", "goldmark" ] // used for the index
+}-->
+Markdown with metadata
+`
+
+	context, out := convert(t, markdown, source)
+	metaData, err := TryGet(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metaData["Title"] != "mmd" {
+		t.Errorf("Title must be 'mmd', but got %v", metaData["Title"])
+	}
+	if out != "<p>Markdown with metadata</p>\n" {
+		t.Errorf("should render '<p>Markdown with metadata</p>', but '%s'", out)
+	}
+}
+
+func TestMeta_WithDecoderSignal(t *testing.T) {
+	decodeLines := func(buf []byte, v interface{}) error {
+		m := v.(*metadata)
+		*m = metadata{}
+		for _, line := range strings.Split(string(buf), "\n") {
+			if kv := strings.SplitN(line, "|", 2); len(kv) == 2 {
+				(*m)[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+			}
+		}
+		return nil
+	}
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithDecoder('|', decodeLines))))
+	source := `<!--|
+Title | mmd
+|-->
+Markdown with metadata
+`
+
+	context, _ := convert(t, markdown, source)
+	if title := Get(context)["Title"]; title != "mmd" {
+		t.Errorf("Title must be 'mmd', but got %v", title)
+	}
+}
+
+func TestMeta_WithTokens(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithTokens("/*", "*/"))))
+	source := `/*:
+Title: mmd
+:*/
+Markdown with metadata
+`
+
+	context, out := convert(t, markdown, source)
+	if title := Get(context)["Title"]; title != "mmd" {
+		t.Errorf("Title must be 'mmd', but got %v", title)
+	}
+	if out != "<p>Markdown with metadata</p>\n" {
+		t.Errorf("should render '<p>Markdown with metadata</p>', but '%s'", out)
+	}
+}
+
+func TestNewWithError(t *testing.T) {
+	if _, err := NewWithError(WithTokens("<!--", "-->"), WithDecoder('{', decodeJSONC)); err != nil {
+		t.Errorf("valid options should not error, but got %s", err)
+	}
+	if _, err := NewWithError(WithTokens("", "-->")); err == nil {
+		t.Error("an empty open token should error")
+	}
+	if _, err := NewWithError(WithDecoder('{', decodeJSONC), WithDecoder('{', decodeJSONC)); err == nil {
+		t.Error("duplicate decoders for a signal should error")
+	}
+}
+
+func TestOrderedKeys(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithOrderedKeys())))
+	source := map[string]string{
+		"yaml": `<!--:
+Zebra: 1
+Title: mmd
+Author:
+  name: gearsix
+# comment: ignored
+Alpha: true
+Tags:
+  - markdown
+:-->
+Markdown with metadata`,
+		"json": `<!--{ "Zebra": 1, "Title": "mmd", "Author": { "name": "gearsix" }, "Alpha": true, "Tags": [ "markdown" ] }-->
+Markdown with metadata`,
+		"toml": `<!--#
+Zebra = 1
+Title = "mmd"
+Alpha = true
+Tags = [ "markdown" ]
+[Author]
+name = "gearsix"
+#-->
+Markdown with metadata`,
+	}
+	expected := map[string][]string{
+		"yaml": {"Zebra", "Title", "Author", "Alpha", "Tags"},
+		"json": {"Zebra", "Title", "Author", "Alpha", "Tags"},
+		"toml": {"Zebra", "Title", "Alpha", "Tags", "Author"},
+	}
+
+	for _, format := range testMetaFormats {
+		context, _ := convert(t, markdown, source[format])
+		keys := OrderedKeys(context)
+		if strings.Join(keys, ",") != strings.Join(expected[format], ",") {
+			t.Errorf("%s: keys must be %v, but got %v", format, expected[format], keys)
+		}
+	}
+}
+
+func TestMeta_TrailingBlock(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithTrailingBlock())))
+	source := map[string]string{
+		"yaml": `Markdown with metadata
+
+<!--:
+Title: mmd
+:-->
+`,
+		"json": `Markdown with metadata
+
+<!--{ "Title": "mmd" }-->
+
+`,
+		"toml": `Markdown with metadata
+<!--#
+Title = "mmd"
+#-->
+
+`,
+	}
+
+	for _, format := range testMetaFormats {
+		context, out := convert(t, markdown, source[format])
+		if title := Get(context)["Title"]; title != "mmd" {
+			t.Errorf("%s: Title must be 'mmd', but got %v", format, title)
+		}
+		if out != "<p>Markdown with metadata</p>\n" {
+			t.Errorf("%s: should render '<p>Markdown with metadata</p>', but '%s'", format, out)
+		}
+	}
+}
+
+func TestMeta_TrailingBlockPrecedence(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithTrailingBlock())))
+	source := `<!--:
+Title: leading
+:-->
+
+Markdown with metadata
+
+<!--:
+Title: trailing
+:-->
+`
+
+	context, out := convert(t, markdown, source)
+	if title := Get(context)["Title"]; title != "trailing" {
+		t.Errorf("Title must be 'trailing', but got %v", title)
+	}
+	if out != "<p>Markdown with metadata</p>\n" {
+		t.Errorf("should render '<p>Markdown with metadata</p>', but '%s'", out)
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+
+	for _, format := range testMetaFormats {
+		context, _ := convert(t, markdown, validSource[format])
+		out, err := MarshalJSON(context)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		var v map[string]interface{}
+		if err = json.Unmarshal(out, &v); err != nil {
+			t.Fatalf("%s: invalid JSON '%s': %s", format, out, err)
+		}
+		if v["Title"] != "mmd" {
+			t.Errorf("%s: Title must be 'mmd', but got '%s'", format, out)
+		}
+	}
+}
+
+func TestMarshalJSON_Error(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+
+	if _, err := MarshalJSON(parser.NewContext()); err != ErrNoMetadata {
+		t.Errorf("should return ErrNoMetadata, but got %v", err)
+	}
+
+	context, _ := convert(t, markdown, invalidSource["json"])
+	if out, err := MarshalJSON(context); err == nil {
+		t.Errorf("should return the parse error, but got '%s'", out)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	v := normalize(metadata{
+		"Author": map[interface{}]interface{}{"name": "gearsix", 1: "one"},
+		"Tags":   []interface{}{map[interface{}]interface{}{"a": 1}},
+	})
+	out, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := `{"Author":{"1":"one","name":"gearsix"},"Tags":[{"a":1}]}`; string(out) != expect {
+		t.Errorf("should marshal to '%s', but got '%s'", expect, out)
+	}
+}
+
+func TestMeta_Empty(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := map[string]string{
+		"yaml": "<!--:\n:-->\nMarkdown with metadata\n",
+		"json": "<!--{}-->\nMarkdown with metadata\n",
+		"toml": "<!--#\n\n#-->\nMarkdown with metadata\n",
+	}
+
+	for _, format := range testMetaFormats {
+		context, out := convert(t, markdown, source[format])
+		metaData, err := TryGet(context)
+		if err != nil {
+			t.Errorf("%s: an empty block should not error, but got %s", format, err)
+		} else if metaData == nil || len(metaData) != 0 {
+			t.Errorf("%s: must be an empty map, but got %#v", format, metaData)
+		}
+		if out != "<p>Markdown with metadata</p>\n" {
+			t.Errorf("%s: should render '<p>Markdown with metadata</p>', but '%s'", format, out)
+		}
+	}
+}
+
+func TestMeta_KeyAliases(t *testing.T) {
+	aliases := map[string]string{
+		"description": "summary",
+		"excerpt":     "summary",
+		"abstract":    "summary",
+	}
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithKeyAliases(aliases))))
+	source := map[string]string{
+		"excerpt": `<!--:
+Title: mmd
+excerpt: Add YAML metadata to the document
+:-->
+Markdown with metadata`,
+		"canonical": `<!--:
+summary: canonical
+abstract: alias
+:-->
+Markdown with metadata`,
+	}
+	expected := map[string]string{
+		"excerpt":   "Add YAML metadata to the document",
+		"canonical": "canonical",
+	}
+
+	for name, src := range source {
+		context, _ := convert(t, markdown, src)
+		metaData := Get(context)
+		if metaData["summary"] != expected[name] {
+			t.Errorf("%s: summary must be '%s', but got %v", name, expected[name], metaData["summary"])
+		}
+		for alias := range aliases {
+			if _, ok := metaData[alias]; ok {
+				t.Errorf("%s: alias '%s' must be dropped", name, alias)
+			}
+		}
+	}
+}
+
+func TestMeta_ReusedContext(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	context := parser.NewContext()
+
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(validSource["yaml"]), &buf, parser.WithContext(context)); err != nil {
+		t.Fatal(err)
+	}
+	if Get(context) == nil {
+		t.Fatal("metadata must be set for the first document")
+	}
+
+	buf.Reset()
+	if err := markdown.Convert([]byte("Markdown without metadata\n"), &buf, parser.WithContext(context)); err != nil {
+		t.Fatal(err)
+	}
+	if metaData := Get(context); metaData != nil {
+		t.Errorf("metadata from the first document should not persist, but got %v", metaData)
+	}
+
+	// the same buffer, overwritten with a document of the same length
+	src := []byte(validSource["yaml"])
+	buf.Reset()
+	if err := markdown.Convert(src, &buf, parser.WithContext(context)); err != nil {
+		t.Fatal(err)
+	}
+	copy(src, strings.Repeat("x", len(src)))
+	buf.Reset()
+	if err := markdown.Convert(src, &buf, parser.WithContext(context)); err != nil {
+		t.Fatal(err)
+	}
+	if metaData := Get(context); metaData != nil {
+		t.Errorf("metadata from a reused buffer should not persist, but got %v", metaData)
+	}
+}
+
+func TestClear(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+
+	context, _ := convert(t, markdown, validSource["json"])
+	Clear(context)
+	if metaData := Get(context); metaData != nil {
+		t.Errorf("metadata must be cleared, but got %v", metaData)
+	}
+}
+
+func TestMeta_CommentedCloseToken(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := map[string]string{
+		"yaml": `<!--:
+Title: mmd # see docs --> here
+# not the end :--> of the block
+Author: don't # the author's name :--> here
+Summary: "quoted # is not a comment"
+:-->
+Markdown with metadata`,
+		"toml": `<!--#
+Title = "mmd" # see docs #--> here
+# not the end #--> of the block
+Author = "don't" # the author's name #--> here
+Summary = "quoted"
+#-->
+Markdown with metadata`,
+	}
+
+	for _, format := range []string{"yaml", "toml"} {
+		context, out := convert(t, markdown, source[format])
+		metaData, err := TryGet(context)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		if metaData["Title"] != "mmd" {
+			t.Errorf("%s: Title must be 'mmd', but got %v", format, metaData["Title"])
+		}
+		if metaData["Author"] != "don't" {
+			t.Errorf("%s: Author must be \"don't\", but got %v", format, metaData["Author"])
+		}
+		if _, ok := metaData["Summary"]; !ok {
+			t.Errorf("%s: the block should not end at a commented close token", format)
+		}
+		if out != "<p>Markdown with metadata</p>\n" {
+			t.Errorf("%s: should render '<p>Markdown with metadata</p>', but '%s'", format, out)
+		}
+	}
+}
+
+func TestMeta_WithValidator(t *testing.T) {
+	validator := func(m metadata) error {
+		if draft, _ := m["Draft"].(bool); !draft {
+			if _, ok := m["Date"]; !ok {
+				return errors.New("Date must be set when Draft is false")
+			}
+		}
+		return nil
+	}
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithValidator(validator))))
+	source := map[string]string{
+		"draft": `<!--{ "Title": "mmd", "Draft": true }-->
+Markdown with metadata`,
+		"dated": `<!--{ "Title": "mmd", "Draft": false, "Date": "2023-01-02" }-->
+Markdown with metadata`,
+		"invalid": `<!--{ "Title": "mmd", "Draft": false }-->
+Markdown with metadata`,
+	}
+
+	for name, src := range source {
+		context, out := convert(t, markdown, src)
+		_, err := TryGet(context)
+		if name == "invalid" {
+			if err == nil || !strings.Contains(err.Error(), "Date must be set") {
+				t.Errorf("%s: should return the validator error, but got %v", name, err)
+			}
+			if !strings.Contains(out, "<!-- meta error, Date must be set") {
+				t.Errorf("%s: should render the validator error, but got '%s'", name, out)
+			}
+		} else if err != nil {
+			t.Errorf("%s: must be valid, but got %s", name, err)
+		}
+	}
+}
+
+func TestMeta_CSV(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := `<!--,
+Name, URL
+goldmark, https://github.com/yuin/goldmark
+mmd, https://github.com/gearsix/goldmark-mmd
+,-->
+Markdown with metadata`
+
+	context, out := convert(t, markdown, source)
+	metaData, err := TryGet(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, ok := metaData["_rows"].([]map[string]string)
+	if !ok || len(rows) != 2 {
+		t.Fatalf("_rows must be a slice with 2 rows, but got %#v", metaData["_rows"])
+	}
+	if rows[0]["Name"] != "goldmark" || rows[0]["URL"] != "https://github.com/yuin/goldmark" {
+		t.Errorf("unexpected first row %v", rows[0])
+	}
+	if rows[1]["Name"] != "mmd" || rows[1]["URL"] != "https://github.com/gearsix/goldmark-mmd" {
+		t.Errorf("unexpected second row %v", rows[1])
+	}
+	if out != "<p>Markdown with metadata</p>\n" {
+		t.Errorf("should render '<p>Markdown with metadata</p>', but '%s'", out)
+	}
+}
+
+func TestMeta_InterruptParagraph(t *testing.T) {
+	source := `Markdown with metadata
+<!--:
+Title: mmd
+:-->
+`
+
+	for _, interrupt := range []bool{true, false} {
+		markdown := goldmark.New(goldmark.WithExtensions(New(WithTrailingBlock(), WithInterruptParagraph(interrupt))))
+		context, _ := convert(t, markdown, source)
+		metaData := Get(context)
+		if interrupt && metaData["Title"] != "mmd" {
+			t.Errorf("interrupt: Title must be 'mmd', but got %v", metaData["Title"])
+		} else if !interrupt && metaData != nil {
+			t.Errorf("no interrupt: the block must not be parsed, but got %v", metaData)
+		}
+	}
+}
+
+func TestGetCopy(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+
+	for _, format := range testMetaFormats {
+		context, _ := convert(t, markdown, validSource[format])
+
+		metaCopy := GetCopy(context)
+		metaCopy["Title"] = "changed"
+		metaCopy["Tags"].([]interface{})[0] = "changed"
+		delete(metaCopy, "Summary")
+
+		metaData := Get(context)
+		if metaData["Title"] != "mmd" {
+			t.Errorf("%s: Title must be 'mmd', but got %v", format, metaData["Title"])
+		}
+		if tags := metaData["Tags"].([]interface{}); tags[0] != "markdown" {
+			t.Errorf("%s: Tag#1 must be 'markdown', but got %v", format, tags[0])
+		}
+		if _, ok := metaData["Summary"]; !ok {
+			t.Errorf("%s: Summary must not be deleted", format)
+		}
+	}
+}
+
+func TestDecodeSource(t *testing.T) {
+	source := "<!--:\nTitle: mmd\nTags:\n  - markdown\n  - goldmark\n:-->\nMarkdown with metadata\n"
+	encode := func(bom unicode.BOMPolicy) []byte {
+		buf, err := unicode.UTF16(unicode.LittleEndian, bom).NewEncoder().Bytes([]byte(source))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf
+	}
+	encodings := map[string]encoding.Encoding{
+		"bom":      nil,
+		"explicit": unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM),
+	}
+	sources := map[string][]byte{
+		"bom":      encode(unicode.UseBOM),
+		"explicit": encode(unicode.IgnoreBOM),
+	}
+
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	for name, enc := range encodings {
+		src, err := DecodeSource(sources[name], enc)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		context, out := convert(t, markdown, string(src))
+		metaData, err := TryGet(context)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if metaData["Title"] != "mmd" {
+			t.Errorf("%s: Title must be 'mmd', but got %v", name, metaData["Title"])
+		}
+		if tags, ok := metaData["Tags"].([]interface{}); !ok || len(tags) != 2 || tags[1] != "goldmark" {
+			t.Errorf("%s: Tags must be [markdown goldmark], but got %v", name, metaData["Tags"])
+		}
+		if out != "<p>Markdown with metadata</p>\n" {
+			t.Errorf("%s: should render '<p>Markdown with metadata</p>', but got %q", name, out)
+		}
+	}
+
+	if src, err := DecodeSource([]byte(source), nil); err != nil || string(src) != source {
+		t.Errorf("a source without a byte order mark should be returned as-is, but got %q, %v", src, err)
+	}
+}
+
+func TestMeta_ImplicitClose(t *testing.T) {
+	source := `<!--:
+Title: mmd
+Tags:
+  - markdown
+  - goldmark
+`
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithImplicitClose())))
+
+	context, out := convert(t, markdown, source)
+	metaData, err := TryGet(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metaData["Title"] != "mmd" {
+		t.Errorf("Title must be 'mmd', but got %v", metaData["Title"])
+	}
+	if out != "" {
+		t.Errorf("should render nothing, but '%s'", out)
+	}
+
+	context, _ = convert(t, goldmark.New(goldmark.WithExtensions(Meta)), source)
+	if _, err = TryGet(context); err == nil || !strings.Contains(err.Error(), "missing its close token") {
+		t.Errorf("a block missing its close token should error, but got %v", err)
+	}
+}
+
+func TestConvertWithMeta(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+
+	var buf bytes.Buffer
+	metaData, err := ConvertWithMeta(markdown, []byte(validSource["yaml"]), &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metaData["Title"] != "mmd" {
+		t.Errorf("Title must be 'mmd', but got %v", metaData["Title"])
+	}
+	if buf.String() != "<p>Markdown with metadata</p>\n" {
+		t.Errorf("should render '<p>Markdown with metadata</p>', but '%s'", buf.String())
+	}
+
+	buf.Reset()
+	if _, err = ConvertWithMeta(markdown, []byte(invalidSource["yaml"]), &buf); err == nil {
+		t.Error("should return the metadata parsing error")
+	}
+}
+
+func TestGetBool(t *testing.T) {
+	spellings := map[string]bool{
+		"yes": true, "no": false,
+		"on": true, "off": false,
+		"true": true, "false": false,
+		"1": true, "0": false,
+		"Yes": true, "OFF": false,
+	}
+	source := map[string]string{
+		"yaml": "<!--:\nDraft: \"%s\"\nFlag: true\n:-->\nMarkdown with metadata",
+		"json": "<!--{ \"Draft\": \"%s\", \"Flag\": true }-->\nMarkdown with metadata",
+		"toml": "<!--#\nDraft = \"%s\"\nFlag = true\n#-->\nMarkdown with metadata",
+	}
+	truthy := goldmark.New(goldmark.WithExtensions(New(WithTruthyStrings())))
+	strict := goldmark.New(goldmark.WithExtensions(Meta))
+
+	for _, format := range testMetaFormats {
+		for spelling, expected := range spellings {
+			src := fmt.Sprintf(source[format], spelling)
+
+			context, _ := convert(t, truthy, src)
+			if v, ok := GetBool(context, "Draft"); !ok || v != expected {
+				t.Errorf("%s: '%s' must be %v, but got %v (%v)", format, spelling, expected, v, ok)
+			}
+			if v, ok := GetBool(context, "Flag"); !ok || !v {
+				t.Errorf("%s: Flag must be true, but got %v (%v)", format, v, ok)
+			}
+			if s, ok := Get(context)["Draft"].(string); !ok || s != spelling {
+				t.Errorf("%s: the stored value should not change, but got %v", format, Get(context)["Draft"])
+			}
+
+			context, _ = convert(t, strict, src)
+			if _, ok := GetBool(context, "Draft"); ok {
+				t.Errorf("%s: '%s' must not be a bool without WithTruthyStrings", format, spelling)
+			}
+		}
+	}
+}
+
+func TestMeta_BestEffort(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithBestEffort())))
+	source := `<!--:
+Title: mmd
+Summary: [ unclosed
+Tags:
+  - markdown
+  - goldmark
+:-->
+Markdown with metadata`
+
+	context, _ := convert(t, markdown, source)
+	if _, err := TryGet(context); err == nil {
+		t.Error("the parsing error should still be returned")
+	}
+	metaData := Get(context)
+	if metaData["Title"] != "mmd" {
+		t.Errorf("Title must be 'mmd', but got %v", metaData["Title"])
+	}
+	if tags, ok := metaData["Tags"].([]interface{}); !ok || len(tags) != 2 {
+		t.Errorf("Tags must be a slice that has 2 elements, but got %v", metaData["Tags"])
+	}
+	if _, ok := metaData["Summary"]; ok {
+		t.Errorf("Summary must not be decoded, but got %v", metaData["Summary"])
+	}
+}
+
+func TestGetDuration(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := map[string]string{
+		"yaml": "<!--:\nTTL: 15m\nCache: 3600\nBad: soon\n:-->\nMarkdown with metadata",
+		"json": "<!--{ \"TTL\": \"15m\", \"Cache\": 3600, \"Bad\": \"soon\" }-->\nMarkdown with metadata",
+		"toml": "<!--#\nTTL = \"15m\"\nCache = 3600\nBad = \"soon\"\n#-->\nMarkdown with metadata",
+	}
+
+	for _, format := range testMetaFormats {
+		context, _ := convert(t, markdown, source[format])
+		if d, ok := GetDuration(context, "TTL"); !ok || d != 15*time.Minute {
+			t.Errorf("%s: TTL must be 15m, but got %v (%v)", format, d, ok)
+		}
+		if d, ok := GetDuration(context, "Cache"); !ok || d != time.Hour {
+			t.Errorf("%s: Cache must be 1h, but got %v (%v)", format, d, ok)
+		}
+		if _, ok := GetDuration(context, "Bad"); ok {
+			t.Errorf("%s: Bad must not be a duration", format)
+		}
+		if _, ok := GetDuration(context, "Missing"); ok {
+			t.Errorf("%s: Missing must not be a duration", format)
+		}
+	}
+}
+
+func TestGetLocalized(t *testing.T) {
+	source := map[string]string{
+		"yaml": "<!--:\ntitle:\n  en: Hello\n  fr: Bonjour\n:-->\nMarkdown with metadata",
+		"json": "<!--{ \"title\": { \"en\": \"Hello\", \"fr\": \"Bonjour\" } }-->\nMarkdown with metadata",
+		"toml": "<!--#\n[title]\nen = \"Hello\"\nfr = \"Bonjour\"\n#-->\nMarkdown with metadata",
+	}
+	fallback := goldmark.New(goldmark.WithExtensions(New(WithDefaultLang("en"))))
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+
+	for _, format := range testMetaFormats {
+		context, _ := convert(t, fallback, source[format])
+		if v, ok := GetLocalized(context, "title", "fr"); !ok || v != "Bonjour" {
+			t.Errorf("%s: title.fr must be 'Bonjour', but got %v (%v)", format, v, ok)
+		}
+		if v, ok := GetLocalized(context, "title", "de"); !ok || v != "Hello" {
+			t.Errorf("%s: title.de should fall back to 'Hello', but got %v (%v)", format, v, ok)
+		}
+		if _, ok := GetLocalized(context, "summary", "fr"); ok {
+			t.Errorf("%s: summary must not be found", format)
+		}
+
+		context, _ = convert(t, markdown, source[format])
+		if _, ok := GetLocalized(context, "title", "de"); ok {
+			t.Errorf("%s: title.de must not be found without WithDefaultLang", format)
+		}
+	}
+}
+
+func TestGetStringMap(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := map[string]string{
+		"yaml": "<!--:\nredirects:\n  /old: /new\n  /a: /b\nmixed:\n  a: b\n  c: 1\n:-->\nMarkdown with metadata",
+		"json": "<!--{ \"redirects\": { \"/old\": \"/new\", \"/a\": \"/b\" }, \"mixed\": { \"a\": \"b\", \"c\": 1 } }-->\nMarkdown with metadata",
+		"toml": "<!--#\n[redirects]\n\"/old\" = \"/new\"\n\"/a\" = \"/b\"\n[mixed]\na = \"b\"\nc = 1\n#-->\nMarkdown with metadata",
+	}
+
+	for _, format := range testMetaFormats {
+		context, _ := convert(t, markdown, source[format])
+		if m, ok := GetStringMap(context, "redirects"); !ok || len(m) != 2 || m["/old"] != "/new" || m["/a"] != "/b" {
+			t.Errorf("%s: unexpected redirects %v (%v), metadata %v", format, m, ok, Get(context))
+		}
+		if _, ok := GetStringMap(context, "mixed"); ok {
+			t.Errorf("%s: a map with a non-string value must not be returned", format)
+		}
+		if _, ok := GetStringMap(context, "missing"); ok {
+			t.Errorf("%s: a missing key must not be returned", format)
+		}
+	}
+}
+
+func TestGetURLValues(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	if values := GetURLValues(parser.NewContext()); values == nil || len(values) != 0 {
+		t.Errorf("should return empty values without metadata, but got %v", values)
+	}
+
+	source := "<!--:\nTitle: mmd\nTags: [markdown, goldmark]\nDraft: false\nParams:\n  a: b\nLinks:\n  - a: b\n:-->\nMarkdown with metadata\n"
+	context, _ := convert(t, markdown, source)
+	expected := url.Values{
+		"Title": {"mmd"},
+		"Tags":  {"markdown", "goldmark"},
+		"Draft": {"false"},
+	}
+	if values := GetURLValues(context); !reflect.DeepEqual(values, expected) {
+		t.Errorf("values must be %v, but got %v", expected, values)
+	}
+}
+
+func TestGetBytes(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := "<!--:\nIcon: AAEC/w==\nTitle: mmd!\nCount: 1\n:-->\nMarkdown with metadata\n"
+
+	context, _ := convert(t, markdown, source)
+	if b, ok := GetBytes(context, "Icon"); !ok || !bytes.Equal(b, []byte{0, 1, 2, 255}) {
+		t.Errorf("Icon should decode to [0 1 2 255], but got %v (%v)", b, ok)
+	}
+	for _, key := range []string{"Title", "Count", "Missing"} {
+		if _, ok := GetBytes(context, key); ok {
+			t.Errorf("%s should not decode", key)
+		}
+	}
+}
+
+func TestGetSpan(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithTrailingBlock())))
+	source := map[string]string{
+		"yaml": "<!--:\nTitle: mmd\n:-->\nMarkdown with metadata\n",
+		"json": `<!--{ "Title": "mmd" }-->
+Markdown with metadata`,
+		"toml": "Markdown with metadata\n\n<!--# Title = \"mmd\" #-->\n",
+	}
+	expected := map[string]string{
+		"yaml": "<!--:\nTitle: mmd\n:-->",
+		"json": `<!--{ "Title": "mmd" }-->`,
+		"toml": `<!--# Title = "mmd" #-->`,
+	}
+
+	for _, format := range testMetaFormats {
+		context, _ := convert(t, markdown, source[format])
+		start, stop, ok := GetSpan(context)
+		if !ok {
+			t.Fatalf("%s: span not found", format)
+		}
+		if span := source[format][start:stop]; span != expected[format] {
+			t.Errorf("%s: span must be '%s', but got '%s'", format, expected[format], span)
+		}
+	}
+}
+
+func TestGetList(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := `<!--[ "a", "b" ]-->
+Markdown with metadata`
+
+	context, out := convert(t, markdown, source)
+	list, ok := GetList(context)
+	if !ok || len(list) != 2 || list[0] != "a" || list[1] != "b" {
+		t.Errorf("list must be [a b], but got %v", list)
+	}
+	if out != "<p>Markdown with metadata</p>\n" {
+		t.Errorf("should render '<p>Markdown with metadata</p>', but '%s'", out)
+	}
+
+	context, _ = convert(t, markdown, validSource["json"])
+	if list, ok = GetList(context); ok {
+		t.Errorf("a JSON object is not a list, but got %v", list)
+	}
+}
+
+func TestMeta_WithSchema(t *testing.T) {
+	schema := []byte(`{
+	"type": "object",
+	"required": [ "Title", "Tags" ],
+	"properties": {
+		"Title": { "type": "string" },
+		"Tags": { "type": "array", "items": { "type": "string" } }
+	}
+}`)
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithSchema(schema))))
+
+	for _, format := range testMetaFormats {
+		context, _ := convert(t, markdown, validSource[format])
+		if _, err := TryGet(context); err != nil {
+			t.Errorf("%s: should match the schema, but got %s", format, err)
+		}
+	}
+
+	source := `<!--{ "Title": 1, "Tags": [ "markdown", 2 ] }-->
+Markdown with metadata`
+	context, _ := convert(t, markdown, source)
+	_, err := TryGet(context)
+	if err == nil {
+		t.Fatal("should not match the schema")
+	}
+	for _, msg := range []string{"/Title: expected string, got integer", "/Tags/1: expected string, got integer"} {
+		if !strings.Contains(err.Error(), msg) {
+			t.Errorf("error should contain '%s', but got '%s'", msg, err)
+		}
+	}
+
+	source = `<!--{ "Title": "mmd" }-->
+Markdown with metadata`
+	context, _ = convert(t, markdown, source)
+	if _, err = TryGet(context); err == nil || !strings.Contains(err.Error(), `missing required property "Tags"`) {
+		t.Errorf("should report the missing Tags, but got %v", err)
+	}
+
+	if _, err = NewWithError(WithSchema([]byte("{"))); err == nil {
+		t.Error("an invalid schema should error")
+	}
+
+	unsupported := []byte(`{ "properties": { "Tags": { "anyOf": [ { "type": "string" } ] } } }`)
+	if _, err = NewWithError(WithSchema(unsupported)); err == nil || !strings.Contains(err.Error(), `/properties/Tags: unsupported keyword "anyOf"`) {
+		t.Errorf("an unsupported keyword should error, but got %v", err)
+	}
+	markdown = goldmark.New(goldmark.WithExtensions(New(WithSchema(unsupported))))
+	context, _ = convert(t, markdown, validSource["json"])
+	if _, err = TryGet(context); err == nil || !strings.Contains(err.Error(), "invalid schema") {
+		t.Errorf("a schema with an unsupported keyword should not validate, but got %v", err)
+	}
+}
+
+func TestPresent(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := map[string]string{
+		"none":    "Markdown without metadata\n",
+		"empty":   "<!--:\n:-->\nMarkdown with metadata\n",
+		"valid":   validSource["yaml"],
+		"invalid": invalidSource["yaml"],
+	}
+
+	for name, src := range source {
+		context, _ := convert(t, markdown, src)
+		if present := Present(context); present != (name != "none") {
+			t.Errorf("%s: Present must be %v", name, !present)
+		}
+	}
+}
+
+func TestMeta_SingleLine(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := map[string]string{
+		"yaml": "<!--: Title: mmd :-->\nMarkdown with metadata\n",
+		"toml": "<!--# Title = \"mmd\" #-->\n\nMarkdown with metadata\n",
+		"json": "<!--{\"Title\": \"mmd\"}-->\nMarkdown with metadata\n",
+	}
+
+	for format, src := range source {
+		context, out := convert(t, markdown, src)
+		if out != "<p>Markdown with metadata</p>\n" {
+			t.Errorf("%s: unexpected output: %q", format, out)
+		}
+		if title := Get(context)["Title"]; title != "mmd" {
+			t.Errorf("%s: Title must be 'mmd', but got %v", format, title)
+		}
+	}
+
+	context, _ := convert(t, markdown, "<!--{\"Title\": \"mmd\"}-->\n")
+	if title := Get(context)["Title"]; title != "mmd" {
+		t.Errorf("metadata-only: Title must be 'mmd', but got %v", title)
+	}
+}
+
+func TestMeta_PreserveComment(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithPreserveComment())))
+
+	for format, src := range validSource {
+		context, out := convert(t, markdown, src)
+		start, stop, _ := GetSpan(context)
+		if comment := src[start:stop]; !strings.HasPrefix(out, comment) {
+			t.Errorf("%s: output should start with %q, but got %q", format, comment, out)
+		}
+		if !strings.Contains(out, "<p>Markdown with metadata</p>") {
+			t.Errorf("%s: output is missing the body: %q", format, out)
+		}
+		if title := Get(context)["Title"]; title != "mmd" {
+			t.Errorf("%s: Title must be 'mmd', but got %v", format, title)
+		}
+	}
+}
+
+func TestMeta_InterpolateKeys(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithInterpolateKeys())))
+	source := `<!--:
+baseurl: https://example.com
+path: /posts/mmd
+canonical: ${baseurl}${path}/
+price: ${dollars}
+:-->
+Markdown with metadata
+`
+	context, _ := convert(t, markdown, source)
+	m, err := TryGet(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["canonical"] != "https://example.com/posts/mmd/" {
+		t.Errorf("canonical should reference baseurl and path, but got %v", m["canonical"])
+	}
+	if m["price"] != "${dollars}" {
+		t.Errorf("unknown references must be left as-is, but got %v", m["price"])
+	}
+
+	source = `<!--:
+a: ${b}
+b: ${a}
+:-->
+Markdown with metadata
+`
+	context, _ = convert(t, markdown, source)
+	if _, err = TryGet(context); err == nil || !strings.Contains(err.Error(), "circular reference") {
+		t.Errorf("should report a circular reference, but got %v", err)
+	}
+}
+
+func TestMeta_JSONCloseWhitespace(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := map[string]string{
+		"same line":  "<!--{ \"Title\": \"mmd\" } -->\nMarkdown with metadata\n",
+		"next line":  "<!--{\n\"Title\": \"mmd\"\n}\n-->\nMarkdown with metadata\n",
+		"blank line": "<!--{\n\"Title\": \"mmd\"\n}  \n\n  -->\nMarkdown with metadata\n",
+	}
+
+	for name, src := range source {
+		context, out := convert(t, markdown, src)
+		m, err := TryGet(context)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		} else if m["Title"] != "mmd" {
+			t.Errorf("%s: Title must be 'mmd', but got %v", name, m["Title"])
+		}
+		if out != "<p>Markdown with metadata</p>\n" {
+			t.Errorf("%s: unexpected output: %q", name, out)
+		}
+	}
+}
+
+func TestMeta_Concurrent(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithOrderedKeys())))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				format := testMetaFormats[(i+j)%len(testMetaFormats)]
+				src := strings.Replace(validSource[format], `mmd`, fmt.Sprintf("mmd-%d-%d", i, j), 1)
+				context := parser.NewContext()
+				var buf bytes.Buffer
+				if err := markdown.Convert([]byte(src), &buf, parser.WithContext(context)); err != nil {
+					t.Error(err)
+					return
+				}
+				if title := Get(context)["Title"]; title != fmt.Sprintf("mmd-%d-%d", i, j) {
+					t.Errorf("%s: Title of conversion %d-%d is %v", format, i, j, title)
+				}
+				if buf.String() != "<p>Markdown with metadata</p>\n" {
+					t.Errorf("%s: unexpected output: %q", format, buf.String())
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func BenchmarkMeta(b *testing.B) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	for _, format := range testMetaFormats {
+		src := []byte(validSource[format])
+		b.Run(format, func(b *testing.B) {
+			b.ReportAllocs()
+			var buf bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := markdown.Convert(src, &buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkMeta_JSONOnly(b *testing.B) {
+	src := []byte(validSource["json"])
+	extensions := map[string]goldmark.Extender{
+		"general":   Meta,
+		"json only": New(WithFormats("json")),
+	}
+	for name, extension := range extensions {
+		markdown := goldmark.New(goldmark.WithExtensions(extension))
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			var buf bytes.Buffer
+			for i := 0; i < b.N; i++ {
+				buf.Reset()
+				if err := markdown.Convert(src, &buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestMeta_Formats(t *testing.T) {
+	general := goldmark.New(goldmark.WithExtensions(Meta))
+	jsonOnly := goldmark.New(goldmark.WithExtensions(New(WithFormats("json"))))
+
+	for _, src := range []string{validSource["json"], invalidSource["json"], "<!--[1, 2]-->\nMarkdown\n"} {
+		expectContext, expect := convert(t, general, src)
+		context, got := convert(t, jsonOnly, src)
+		m, err := TryGet(context)
+		expectMeta, expectErr := TryGet(expectContext)
+		if !reflect.DeepEqual(m, expectMeta) || (err == nil) != (expectErr == nil) {
+			t.Errorf("%q: must be %v (%v), but got %v (%v)", src, expectMeta, expectErr, m, err)
+		}
+		if got != expect {
+			t.Errorf("%q: should render %q, but got %q", src, expect, got)
+		}
+	}
+
+	context, _ := convert(t, jsonOnly, validSource["yaml"])
+	if m := Get(context); m != nil {
+		t.Errorf("YAML metadata must be ignored, but got %v", m)
+	}
+
+	if _, err := NewWithError(WithFormats("json", "xml")); err == nil {
+		t.Error("an unknown format must be an error")
+	}
+}
+
+func TestMeta_NamedFormats(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithNamedFormats())))
+	source := map[string]string{
+		"yaml":       "<!--yaml\nTitle: mmd\nTags:\n  - markdown\n-->\nMarkdown with metadata\n",
+		"named yaml": "<!--yaml\nTitle: mmd\nyaml-->\nMarkdown with metadata\n",
+		"json":       "<!--json\n{ \"Title\": \"mmd\" }\n-->\nMarkdown with metadata\n",
+		"toml":       "<!--toml Title = \"mmd\" -->\nMarkdown with metadata\n",
+		"signal":     validSource["yaml"],
+		"YAML":       "<!--YAML\nTitle: mmd\n-->\nMarkdown with metadata\n",
+		"Yaml":       "<!--Yaml\nTitle: mmd\nyaml-->\nMarkdown with metadata\n",
+		"Json":       "<!--Json { \"Title\": \"mmd\" } JSON-->\nMarkdown with metadata\n",
+	}
+
+	for name, src := range source {
+		context, out := convert(t, markdown, src)
+		m, err := TryGet(context)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+		} else if m["Title"] != "mmd" {
+			t.Errorf("%s: Title must be 'mmd', but got %v", name, m["Title"])
+		}
+		if out != "<p>Markdown with metadata</p>\n" {
+			t.Errorf("%s: unexpected output: %q", name, out)
+		}
+	}
+
+	src := []byte(source["yaml"])
+	context, _ := convert(t, goldmark.New(goldmark.WithExtensions(Meta)), string(src))
+	if Present(context) {
+		t.Error("format names must not be accepted without WithNamedFormats")
+	}
+}
+
+func TestMeta_AutoDetect(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithAutoDetect())))
+	source := map[string]string{
+		"yaml": "<!--\nTitle: mmd\nTags:\n  - markdown\n-->\nMarkdown with metadata\n",
+		"json": "<!--\n{ \"Title\": \"mmd\", \"Tags\": [ \"markdown\" ] }\n-->\nMarkdown with metadata\n",
+		"toml": "<!--\nTitle = \"mmd\"\nTags = [ \"markdown\" ]\n-->\nMarkdown with metadata\n",
+	}
+
+	for _, format := range testMetaFormats {
+		context, out := convert(t, markdown, source[format])
+		m, err := TryGet(context)
+		if err != nil {
+			t.Errorf("%s: %s", format, err)
+		} else if m["Title"] != "mmd" {
+			t.Errorf("%s: Title must be 'mmd', but got %v", format, m["Title"])
+		}
+		if out != "<p>Markdown with metadata</p>\n" {
+			t.Errorf("%s: unexpected output: %q", format, out)
+		}
+
+		context, _ = convert(t, markdown, validSource[format])
+		if Get(context)["Title"] != "mmd" {
+			t.Errorf("%s: signalled blocks should still be parsed", format)
+		}
+
+		context, _ = convert(t, goldmark.New(goldmark.WithExtensions(Meta)), source[format])
+		if Present(context) {
+			t.Errorf("%s: blocks without a signal must not be accepted without WithAutoDetect", format)
+		}
+	}
+}
+
+func TestMeta_MaxBlockSize(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithMaxBlockSize(64))))
+	source := "<!--:\n" + strings.Repeat("Key: a value that goes on\n", 100) + ":-->\n\nMarkdown with metadata\n"
+
+	context, out := convert(t, markdown, source)
+	if _, err := TryGet(context); err == nil || !strings.Contains(err.Error(), "exceeds 64 bytes") {
+		t.Errorf("should report the block is too large, but got %v", err)
+	}
+	if !strings.Contains(out, "<p>Markdown with metadata</p>") {
+		t.Errorf("the rest of the document should render, but got %q", out)
+	}
+
+	source = "<!--:\n" + strings.Repeat("Key: a value that goes on\n", 100) + "\nMarkdown without a close token\n"
+	context, out = convert(t, markdown, source)
+	if _, err := TryGet(context); err == nil || !strings.Contains(err.Error(), "exceeds 64 bytes") {
+		t.Errorf("should report the unterminated block is too large, but got %v", err)
+	}
+	if !strings.Contains(out, "<p>Markdown without a close token</p>") {
+		t.Errorf("an unterminated block should not consume the document, but got %q", out)
+	}
+
+	markdown = goldmark.New(goldmark.WithExtensions(New(WithMaxBlockSize(1024))))
+	for _, format := range testMetaFormats {
+		context, _ = convert(t, markdown, validSource[format])
+		if _, err := TryGet(context); err != nil {
+			t.Errorf("%s: a block within the limit should parse, but got %v", format, err)
+		}
+	}
+}
+
+func TestMeta_MetaPrefix(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithStoresInDocument(), WithMetaPrefix("mmd."))))
+
+	for _, format := range testMetaFormats {
+		doc := markdown.Parser().Parse(text.NewReader([]byte(validSource[format])))
+		m := doc.OwnerDocument().Meta()
+		if m["mmd.Title"] != "mmd" {
+			t.Errorf("%s: mmd.Title must be 'mmd', but got %v", format, m["mmd.Title"])
+		}
+		if _, ok := m["Title"]; ok {
+			t.Errorf("%s: Title should only be stored with the prefix", format)
+		}
+	}
+}
+
+func TestMeta_StoreUnderKey(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithStoreUnderKey("mmd"))))
+
+	for _, format := range testMetaFormats {
+		doc := markdown.Parser().Parse(text.NewReader([]byte(validSource[format])))
+		m := doc.OwnerDocument().Meta()
+		if len(m) != 1 {
+			t.Errorf("%s: only mmd must be stored, but got %v", format, m)
+		}
+		stored, ok := m["mmd"].(map[string]interface{})
+		if !ok {
+			t.Fatalf("%s: mmd must be a map, but got %#v", format, m["mmd"])
+		}
+		if stored["Title"] != "mmd" || len(stored) != 3 {
+			t.Errorf("%s: mmd must be the full metadata, but got %v", format, stored)
+		}
+	}
+
+	markdown = goldmark.New(goldmark.WithExtensions(New(WithStoresInDocument(), WithStoreUnderKey("mmd"))))
+	m := markdown.Parser().Parse(text.NewReader([]byte(validSource["yaml"]))).OwnerDocument().Meta()
+	if _, ok := m["mmd"].(map[string]interface{}); !ok || m["Title"] != "mmd" {
+		t.Errorf("both the keys and the map must be stored, but got %v", m)
+	}
+}
+
+func TestRenderMeta(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	var buf bytes.Buffer
+	if err := RenderMeta(parser.NewContext(), "json", &buf); !errors.Is(err, ErrNoMetadata) {
+		t.Errorf("should return ErrNoMetadata, but got %v", err)
+	}
+	context, _ := convert(t, markdown, validSource["yaml"])
+
+	formats := map[string]dati.DataFormat{"json": dati.JSON, "toml": dati.TOML}
+	for name, format := range formats {
+		buf.Reset()
+		if err := RenderMeta(context, name, &buf); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		var m map[string]interface{}
+		if err := dati.LoadData(format, &buf, &m); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if m["Title"] != "mmd" {
+			t.Errorf("%s: Title must be 'mmd', but got %v", name, m["Title"])
+		}
+		if tags, ok := m["Tags"].([]interface{}); !ok || len(tags) != 2 || tags[0] != "markdown" {
+			t.Errorf("%s: Tags must be [markdown goldmark], but got %v", name, m["Tags"])
+		}
+	}
+
+	var unsupported dati.ErrUnsupportedData
+	if err := RenderMeta(context, "xml", &buf); !errors.As(err, &unsupported) {
+		t.Errorf("should return dati.ErrUnsupportedData, but got %v", err)
+	}
+}
+
+func TestMeta_OpenMidLine(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := []string{
+		"<b>mmd</b> uses <!--: to open YAML metadata :-->\n",
+		"<i>Title</i> <!--{ \"Title\": \"mmd\" }-->\n",
+		"<a:Title: mmd :-->\n",
+	}
+
+	for _, src := range source {
+		context, _ := convert(t, markdown, src)
+		if Present(context) {
+			t.Errorf("%q must not be treated as metadata", src)
+		}
+	}
+}
+
+func TestMeta_BaseMetadata(t *testing.T) {
+	base := map[string]interface{}{
+		"Layout": "post",
+		"Author": "site",
+		"Params": map[string]interface{}{"Comments": true, "Theme": "light"},
+	}
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithBaseMetadata(base))))
+	source := "<!--:\nTitle: mmd\nAuthor: gearsix\nParams:\n  Theme: dark\n:-->\nMarkdown with metadata\n"
+
+	context, _ := convert(t, markdown, source)
+	m := Get(context)
+	if m["Layout"] != "post" || m["Author"] != "gearsix" || m["Title"] != "mmd" {
+		t.Errorf("unexpected merged metadata: %v", m)
+	}
+	params, _ := m["Params"].(map[string]interface{})
+	if params["Comments"] != true || params["Theme"] != "dark" {
+		t.Errorf("Params must be merged, but got %v", m["Params"])
+	}
+	if base["Author"] != "site" || base["Params"].(map[string]interface{})["Theme"] != "light" {
+		t.Errorf("the base metadata must not be modified, but got %v", base)
+	}
+
+	defaults, err := Parse([]byte("<!--:\nParams:\n  Comments: true\n  Theme: light\n:-->\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	markdown = goldmark.New(goldmark.WithExtensions(New(WithBaseMetadata(defaults))))
+	context, _ = convert(t, markdown, source)
+	params, _ = Get(context)["Params"].(map[string]interface{})
+	if params["Comments"] != true || params["Theme"] != "dark" {
+		t.Errorf("Params parsed from yaml must be merged, but got %v", Get(context)["Params"])
+	}
+}
+
+func TestBodyLineOffset(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	lines := map[string]int{"yaml": 7, "json": 1, "toml": 3}
+
+	for _, format := range testMetaFormats {
+		if BodyLineOffset(parser.NewContext()) != 0 {
+			t.Errorf("%s: the offset must be 0 without metadata", format)
+		}
+		context, _ := convert(t, markdown, validSource[format])
+		if n := BodyLineOffset(context); n != lines[format] {
+			t.Errorf("%s: the offset must be %d, but got %d", format, lines[format], n)
+		}
+	}
+}
+
+func TestMeta_FileReferences(t *testing.T) {
+	fsys := fstest.MapFS{
+		"desc.md": &fstest.MapFile{Data: []byte("A long description.\n")},
+	}
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithFileReferences(fsys))))
+	source := "<!--:\nTitle: mmd\nDescription: \"@file:desc.md\"\n:-->\nMarkdown with metadata\n"
+
+	context, _ := convert(t, markdown, source)
+	m, err := TryGet(context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m["Description"] != "A long description.\n" {
+		t.Errorf("Description must be read from desc.md, but got %q", m["Description"])
+	}
+
+	source = strings.Replace(source, "desc.md", "missing.md", 1)
+	context, _ = convert(t, markdown, source)
+	if _, err = TryGet(context); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("a missing file must be an error, but got %v", err)
+	}
+}
+
+func TestMeta_StrictJSON(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithStrictJSON())))
+	source := map[string]string{
+		"top-level": `<!--{ "Title": "mmd", "Tags": [], "Title": "mmd" }-->`,
+		"nested":    `<!--{ "Title": "mmd", "Params": { "a": 1, "b": { "a": 2 }, "a": 3 } }-->`,
+		"list":      `<!--[ { "Title": "mmd", "Title": "mmd" } ]-->`,
+	}
+
+	for name, src := range source {
+		context, _ := convert(t, markdown, src+"\nMarkdown with metadata\n")
+		if _, err := TryGet(context); err == nil || !strings.Contains(err.Error(), "duplicate key") {
+			t.Errorf("%s: should report a duplicate key, but got %v", name, err)
+		}
+	}
+
+	markdown = goldmark.New(goldmark.WithExtensions(New(WithStrictJSON(), WithAutoDetect())))
+	context, _ := convert(t, markdown, "<!--\n{ \"Title\": \"mmd\", \"Title\": \"mmd\" }\n-->\nMarkdown with metadata\n")
+	if _, err := TryGet(context); err == nil || !strings.Contains(err.Error(), "duplicate key") {
+		t.Errorf("auto-detected JSON should report a duplicate key, but got %v", err)
+	}
+
+	src := `<!--{ "Title": "mmd", "Params": { "Title": "mmd" }, "Tags": [ { "Title": "mmd" } ] }-->` + "\nMarkdown with metadata\n"
+	context, _ = convert(t, markdown, src)
+	if _, err := TryGet(context); err != nil {
+		t.Errorf("keys repeated in different objects must be allowed, but got %v", err)
+	}
+}
+
+func TestMeta_NormalizeDates(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithNormalizeDates())))
+	source := map[string]string{
+		"yaml": "<!--:\nDate: 2023-01-02\nUpdated: \"2023-01-02T15:04:05Z\"\nVersion: \"2023\"\n:-->\nMarkdown with metadata",
+		"json": "<!--{ \"Date\": \"2023-01-02\", \"Updated\": \"2023-01-02T15:04:05Z\", \"Version\": \"2023\" }-->\nMarkdown with metadata",
+		"toml": "<!--#\nDate = 2023-01-02\nUpdated = \"2023-01-02T15:04:05Z\"\nVersion = \"2023\"\n#-->\nMarkdown with metadata",
+	}
+	date := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+	updated := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+
+	for _, format := range testMetaFormats {
+		context, _ := convert(t, markdown, source[format])
+		m := Get(context)
+		if tm, ok := m["Date"].(time.Time); !ok || !tm.Equal(date) {
+			t.Errorf("%s: Date must be %v, but got %#v", format, date, m["Date"])
+		}
+		if tm, ok := m["Updated"].(time.Time); !ok || !tm.Equal(updated) {
+			t.Errorf("%s: Updated must be %v, but got %#v", format, updated, m["Updated"])
+		}
+		if m["Version"] != "2023" {
+			t.Errorf("%s: Version must not be converted, but got %#v", format, m["Version"])
+		}
+	}
+}
+
+func TestMeta_Location(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithNormalizeDates(), WithLocation(loc))))
+	source := "<!--:\nDate: \"2023-01-02 15:04:05\"\nUpdated: \"2023-01-02T15:04:05Z\"\n:-->\nMarkdown with metadata"
+
+	context, _ := convert(t, markdown, source)
+	m := Get(context)
+	date, ok := m["Date"].(time.Time)
+	if !ok {
+		t.Fatalf("Date must be a time.Time, but got %#v", m["Date"])
+	}
+	if date.Location() != loc || !date.Equal(time.Date(2023, 1, 2, 15, 4, 5, 0, loc)) {
+		t.Errorf("Date must be 2023-01-02 15:04:05 in %v, but got %v", loc, date)
+	}
+	updated := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	if tm, ok := m["Updated"].(time.Time); !ok || !tm.Equal(updated) {
+		t.Errorf("Updated should keep its zone, but got %#v", m["Updated"])
+	}
+}
+
+func TestRange(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	Range(parser.NewContext(), func(string, interface{}) bool {
+		t.Error("fn must not be called without metadata")
+		return true
+	})
+
+	context, _ := convert(t, markdown, validSource["yaml"])
+	var keys []string
+	Range(context, func(key string, value interface{}) bool {
+		if fmt.Sprint(value) != fmt.Sprint(Get(context)[key]) {
+			t.Errorf("%s: unexpected value %v", key, value)
+		}
+		keys = append(keys, key)
+		return true
+	})
+	if strings.Join(keys, ",") != "Summary,Tags,Title" {
+		t.Errorf("keys must be sorted, but got %v", keys)
+	}
+
+	keys = nil
+	Range(context, func(key string, value interface{}) bool {
+		keys = append(keys, key)
+		return len(keys) < 2
+	})
+	if strings.Join(keys, ",") != "Summary,Tags" {
+		t.Errorf("should stop when fn returns false, but got %v", keys)
+	}
+}
+
+func TestMeta_UniformClose(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithUniformClose())))
+	source := map[string]string{
+		"yaml": "<!--:\nTitle: mmd\nTags:\n  - markdown\n-->\nMarkdown with metadata\n",
+		"json": "<!--{ \"Title\": \"mmd\" } -->\nMarkdown with metadata\n",
+		"toml": "<!--#\nTitle = \"mmd\" # the title\n-->\nMarkdown with metadata\n",
+	}
+
+	for _, format := range testMetaFormats {
+		for _, src := range []string{source[format], validSource[format]} {
+			context, out := convert(t, markdown, src)
+			m, err := TryGet(context)
+			if err != nil {
+				t.Errorf("%s: %s", format, err)
+			} else if m["Title"] != "mmd" {
+				t.Errorf("%s: Title must be 'mmd', but got %v", format, m["Title"])
+			}
+			if out != "<p>Markdown with metadata</p>\n" {
+				t.Errorf("%s: unexpected output: %q", format, out)
+			}
+		}
+	}
+}
+
+func TestMeta_CompatKeys(t *testing.T) {
+	key := parser.NewContextKey()
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithCompatKeys(key))))
+
+	for _, format := range testMetaFormats {
+		context, _ := convert(t, markdown, validSource[format])
+		m, ok := context.Get(key).(map[string]interface{})
+		if !ok {
+			t.Fatalf("%s: metadata must be stored under the compat key, but got %T", format, context.Get(key))
+		}
+		if m["Title"] != "mmd" || Get(context)["Title"] != "mmd" {
+			t.Errorf("%s: Title must be 'mmd' under both keys, but got %v and %v", format, m["Title"], Get(context)["Title"])
+		}
+	}
+
+	context := parser.NewContext()
+	for _, source := range []string{validSource["yaml"], "Markdown without metadata\n"} {
+		var buf bytes.Buffer
+		if err := markdown.Convert([]byte(source), &buf, parser.WithContext(context)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if m := context.Get(key); m != nil {
+		t.Errorf("metadata from the first document should not persist under the compat key, but got %v", m)
+	}
+	context, _ = convert(t, markdown, validSource["yaml"])
+	Clear(context)
+	if m := context.Get(key); m != nil {
+		t.Errorf("the compat key must be cleared, but got %v", m)
+	}
+}
+
+func TestMeta_TabIndentation(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := "<!--:\nTitle: mmd\nParams:\n\tTheme: dark\n:-->\nMarkdown with metadata\n"
+
+	context, _ := convert(t, markdown, source)
+	if _, err := TryGet(context); err == nil || !strings.Contains(err.Error(), "yaml uses tab indentation at line 4") || strings.Count(err.Error(), "meta:") != 1 {
+		t.Errorf("should report the tab indentation, but got %v", err)
+	}
+}
+
+func TestParse(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+
+	for _, format := range testMetaFormats {
+		context, _ := convert(t, markdown, validSource[format])
+		m, err := Parse([]byte(validSource[format]))
+		if err != nil {
+			t.Errorf("%s: %s", format, err)
+		} else if !reflect.DeepEqual(m, Get(context)) {
+			t.Errorf("%s: should match the converted metadata %v, but got %v", format, Get(context), m)
+		}
+
+		if _, err = Parse([]byte(invalidSource[format])); err == nil {
+			t.Errorf("%s: invalid metadata should return an error", format)
+		}
+	}
+
+	if m, err := Parse([]byte("Markdown without metadata\n")); m != nil || err != nil {
+		t.Errorf("should return nil and nil without metadata, but got %v and %v", m, err)
+	}
+}
+
+func TestMeta_AllowedKeys(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithAllowedKeys("Title", "Summary", "Tags"))))
+
+	for _, format := range testMetaFormats {
+		context, _ := convert(t, markdown, validSource[format])
+		if _, err := TryGet(context); err != nil {
+			t.Errorf("%s: allowed keys should parse, but got %v", format, err)
+		}
+	}
+
+	source := "<!--:\ntittle: mmd\nTags: [markdown]\nDraft: true\n:-->\nMarkdown with metadata\n"
+	context, _ := convert(t, markdown, source)
+	if _, err := TryGet(context); err == nil || !strings.Contains(err.Error(), "unknown keys: Draft, tittle") {
+		t.Errorf("should name the unknown keys, but got %v", err)
+	}
+}
+
+func TestMeta_SkipFirstLineIf(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithSkipFirstLineIf("#!"))))
+
+	for _, format := range testMetaFormats {
+		context, out := convert(t, markdown, "#!markdown\n"+validSource[format])
+		if title := Get(context)["Title"]; title != "mmd" {
+			t.Errorf("%s: Title must be 'mmd', but got %v", format, title)
+		}
+		if out != "<p>Markdown with metadata</p>\n" {
+			t.Errorf("%s: unexpected output: %q", format, out)
+		}
+	}
+
+	context, _ := convert(t, markdown, "markdown\n"+validSource["yaml"])
+	if Present(context) {
+		t.Error("a first line without the prefix must not be skipped")
+	}
+}
+
+func TestMeta_WarningHandler(t *testing.T) {
+	var warnings []string
+	markdown := goldmark.New(goldmark.WithExtensions(New(
+		WithKeyAliases(map[string]string{"title": "Title", "tags": "Tags"}),
+		WithWarningHandler(func(msg string) {
+			warnings = append(warnings, msg)
+		}),
+	)))
+	source := "<!--:\ntitle: mmd\nTags: [markdown]\ntags: [goldmark]\n:-->\nMarkdown with metadata\n"
+
+	context, _ := convert(t, markdown, source)
+	if _, err := TryGet(context); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		`meta: "tags" is an alias of "Tags", which is already set`,
+		`meta: "title" is an alias of "Title"`,
+	}
+	if !reflect.DeepEqual(warnings, expected) {
+		t.Errorf("warnings must be %q, but got %q", expected, warnings)
+	}
+}
+
+func TestMeta_JSONCloseOffset(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := map[string]string{
+		"at brace":       `<!--{"Title":"mmd","Count":10}-->`,
+		"spaces":         `<!--{ "Title": "mmd", "Count": 10   }-->`,
+		"nested":         `<!--{"Title":"mmd","Count":10,"Params":{"a":{"b":1}}}-->`,
+		"brace in value": `<!--{"Title":"mmd","Count":10,"Note":"}"}-->`,
+		"multi-line":     "<!--{\n\"Title\": \"mmd\",\n\"Count\": 10}-->",
+	}
+
+	for name, src := range source {
+		context, out := convert(t, markdown, src+"\nMarkdown with metadata\n")
+		m, err := TryGet(context)
+		if err != nil {
+			t.Errorf("%s: %s", name, err)
+			continue
+		}
+		if m["Title"] != "mmd" || m["Count"] != float64(10) {
+			t.Errorf("%s: the last value must not be truncated, but got %v", name, m)
+		}
+		if start, stop, _ := GetSpan(context); start != 0 || stop != len(src) {
+			t.Errorf("%s: span must be 0-%d, but got %d-%d", name, len(src), start, stop)
+		}
+		if out != "<p>Markdown with metadata</p>\n" {
+			t.Errorf("%s: unexpected output: %q", name, out)
+		}
+	}
+}
+
+func TestParseReader(t *testing.T) {
+	for _, format := range testMetaFormats {
+		body := "\nMarkdown with metadata\n<!--: not metadata :-->\n"
+		src := validSource[format][:strings.LastIndex(validSource[format], "-->")+3]
+		pr, pw := io.Pipe()
+		go func() {
+			pw.Write([]byte(src + body))
+			pw.Close()
+		}()
+
+		r := bufio.NewReader(pr)
+		m, err := ParseReader(r)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		expected, _ := Parse([]byte(validSource[format]))
+		if !reflect.DeepEqual(m, expected) {
+			t.Errorf("%s: should match Parse %v, but got %v", format, expected, m)
+		}
+		rest, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(rest) != body {
+			t.Errorf("%s: the body must be left in the reader, but got %q", format, rest)
+		}
+	}
+
+	r := bufio.NewReader(strings.NewReader("Markdown without metadata\n"))
+	if m, err := ParseReader(r); m != nil || err != nil {
+		t.Errorf("should return nil and nil without metadata, but got %v and %v", m, err)
+	}
+	if rest, _ := io.ReadAll(r); string(rest) != "Markdown without metadata\n" {
+		t.Errorf("nothing must be read without metadata, but got %q", rest)
+	}
+	if _, err := ParseReader(bufio.NewReader(strings.NewReader("<!--:\nTitle: mmd\n"))); err == nil {
+		t.Error("a block without a close token should return an error")
+	}
+}
+
+func TestMeta_NoLeadingBlank(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := map[string]string{
+		"<!--:\nTitle: mmd\n:-->\n```go\nx\n```\n":     "<pre><code class=\"language-go\">x\n</code></pre>\n",
+		"<!--:\nTitle: mmd\n:-->\nText\n":              "<p>Text</p>\n",
+		"<!--:\nTitle: mmd\n:-->\n\n\nText\n":          "<p>Text</p>\n",
+		"<!--:\nTitle: mmd\n:-->   \nText\n":           "<p>Text</p>\n",
+		"<!--: Title: mmd :--> \n\nText\n":             "<p>Text</p>\n",
+		"<!--:\nTitle: mmd\n:-->\n\n":                  "",
+		"<!--{ \"Title\": \"mmd\" }-->\n\n# Heading\n": "<h1>Heading</h1>\n",
+	}
+
+	for src, expected := range source {
+		_, out := convert(t, markdown, src)
+		if out != expected {
+			t.Errorf("%q should render %q, but got %q", src, expected, out)
+		}
+		_, body, err := ExtractMeta([]byte(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, without := convert(t, markdown, string(body)); out != without {
+			t.Errorf("%q should render as it does without the block, %q, but got %q", src, without, out)
+		}
+	}
+}
+
+func TestMeta_Types(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithTypes(map[string]string{
+		"Draft":   "bool",
+		"Weight":  "int",
+		"Tags":    "[]string",
+		"Date":    "time",
+		"Version": "string",
+	}))))
+	source := map[string]string{
+		"yaml": "<!--:\nDraft: \"true\"\nWeight: \"42\"\nTags: [markdown, goldmark]\nDate: \"2023-01-02\"\nVersion: 2\n:-->\nMarkdown with metadata",
+		"json": "<!--{ \"Draft\": \"true\", \"Weight\": \"42\", \"Tags\": [\"markdown\", \"goldmark\"], \"Date\": \"2023-01-02\", \"Version\": 2 }-->\nMarkdown with metadata",
+		"toml": "<!--#\nDraft = \"true\"\nWeight = \"42\"\nTags = [\"markdown\", \"goldmark\"]\nDate = \"2023-01-02\"\nVersion = 2\n#-->\nMarkdown with metadata",
+	}
+
+	for _, format := range testMetaFormats {
+		context, _ := convert(t, markdown, source[format])
+		m, err := TryGet(context)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		if m["Draft"] != true || m["Weight"] != 42 || m["Version"] != "2" {
+			t.Errorf("%s: unexpected values %#v", format, m)
+		}
+		if tags, ok := m["Tags"].([]string); !ok || len(tags) != 2 {
+			t.Errorf("%s: Tags must be a []string, but got %#v", format, m["Tags"])
+		}
+		if _, ok := m["Date"].(time.Time); !ok {
+			t.Errorf("%s: Date must be a time.Time, but got %#v", format, m["Date"])
+		}
+	}
+
+	context, _ := convert(t, markdown, "<!--:\nWeight: heavy\n:-->\n")
+	if _, err := TryGet(context); err == nil || !strings.Contains(err.Error(), "Weight") {
+		t.Errorf("an impossible conversion must be an error, but got %v", err)
+	}
+
+	if _, err := NewWithError(WithTypes(map[string]string{"Weight": "number"})); err == nil {
+		t.Error("an unknown type must be an error")
+	}
+}
+
+func TestMeta_AltCloseToken(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithAltCloseToken("--#"))))
+	source := map[string]string{
+		"yaml": "<!--:\nTitle: mmd\n:--#\nMarkdown with metadata\n",
+		"json": "<!--{ \"Title\": \"mmd\" }--#\nMarkdown with metadata\n",
+		"toml": "<!--# Title = \"mmd\" #--#\nMarkdown with metadata\n",
+	}
+
+	for _, format := range testMetaFormats {
+		for _, src := range []string{source[format], validSource[format]} {
+			context, out := convert(t, markdown, src)
+			m, err := TryGet(context)
+			if err != nil {
+				t.Errorf("%s: %s", format, err)
+			} else if m["Title"] != "mmd" {
+				t.Errorf("%s: Title must be 'mmd', but got %v", format, m["Title"])
+			}
+			if out != "<p>Markdown with metadata</p>\n" {
+				t.Errorf("%s: unexpected output: %q", format, out)
+			}
+		}
+	}
+}
+
+func TestExtractMeta(t *testing.T) {
+	body := map[string]string{
+		"yaml": "\nMarkdown with metadata\n",
+		"json": "Markdown with metadata",
+		"toml": "Markdown with metadata\n",
+	}
+
+	for _, format := range testMetaFormats {
+		m, b, err := ExtractMeta([]byte(validSource[format]))
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		if m["Title"] != "mmd" {
+			t.Errorf("%s: Title must be 'mmd', but got %v", format, m["Title"])
+		}
+		if string(b) != body[format] {
+			t.Errorf("%s: body must be %q, but got %q", format, body[format], b)
+		}
+	}
+
+	source := []byte("Markdown without metadata\n")
+	if m, b, err := ExtractMeta(source); m != nil || err != nil || !bytes.Equal(b, source) {
+		t.Errorf("should return the source as the body without metadata, but got %v, %q and %v", m, b, err)
+	}
+}
+
+func TestMeta_MaxDepth(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithMaxDepth(3))))
+	source := map[string]string{
+		"deep":    "<!--:\na:\n  b:\n    c:\n      - d: 1\n:-->\nMarkdown with metadata\n",
+		"shallow": "<!--:\na:\n  b: [1, 2]\n:-->\nMarkdown with metadata\n",
+	}
+
+	context, _ := convert(t, markdown, source["deep"])
+	if _, err := TryGet(context); err == nil || !strings.Contains(err.Error(), "nested 5 levels deep, more than 3") {
+		t.Errorf("should report the depth, but got %v", err)
+	}
+
+	context, _ = convert(t, markdown, source["shallow"])
+	if _, err := TryGet(context); err != nil {
+		t.Errorf("metadata 3 levels deep must be allowed, but got %v", err)
+	}
+}
+
+func TestMeta_Priority(t *testing.T) {
+	source := "<!--:\nTitle: mmd\n:-->\nMarkdown with metadata\n"
+
+	// goldmark's HTML block parser (priority 900) also triggers on "<!--"
+	for priority, present := range map[int]bool{0: true, 800: true, 950: false} {
+		markdown := goldmark.New(goldmark.WithExtensions(New(WithPriority(priority))))
+		context, out := convert(t, markdown, source)
+		if m := Get(context); (m["Title"] == "mmd") != present {
+			t.Errorf("priority %d: metadata present must be %v, but got %v", priority, present, m)
+		}
+		if html := strings.Contains(out, "raw HTML omitted"); html == present {
+			t.Errorf("priority %d: HTML block must be rendered %v, but got %q", priority, !present, out)
+		}
+	}
+}
+
+func TestMeta_StoresInDocumentJSON(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithStoresInDocument())))
+	source := []byte("<!--:\nTitle: mmd\nAuthor:\n  Name: gearsix\n  Links:\n    - site: example.com\n:-->\nMarkdown with metadata\n")
+
+	doc := markdown.Parser().Parse(text.NewReader(source))
+	b, err := json.Marshal(doc.OwnerDocument().Meta())
+	if err != nil {
+		t.Fatalf("Document.Meta() should marshal to JSON, but got %v", err)
+	}
+	expect := `{"Author":{"Links":[{"site":"example.com"}],"Name":"gearsix"},"Title":"mmd"}`
+	if string(b) != expect {
+		t.Errorf("must be %s, but got %s", expect, b)
+	}
+}
+
+func TestMeta_YAMLKnownFields(t *testing.T) {
+	type author struct {
+		Name string
+	}
+	type schema struct {
+		Title   string   `yaml:"Title"`
+		Summary string   `yaml:"Summary"`
+		Tags    []string `yaml:"Tags"`
+		Authors []author `yaml:"Authors"`
+	}
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithYAMLKnownFields(&schema{}))))
+	source := map[string]string{
+		"<!--:\nTitle: mmd\nTags: [markdown]\nAuthors:\n  - name: gearsix\n:-->\n": "",
+		"<!--:\nTitle: mmd\nTitel: mmd\n:-->\n":                                    "field Titel not found",
+		"<!--:\nTitle: mmd\nAuthors:\n  - name: gearsix\n    email: x\n:-->\n":     "field email not found",
+		"<!--:\nTitle: [mmd]\n:-->\n":                                              "cannot unmarshal",
+		"<!--{ \"Title\": \"mmd\", \"Titel\": \"mmd\" }-->\n":                      "",
+	}
+
+	for src, expect := range source {
+		context, _ := convert(t, markdown, src)
+		_, err := TryGet(context)
+		if expect == "" && err != nil {
+			t.Errorf("%q: should parse, but got %v", src, err)
+		} else if expect != "" && (err == nil || !strings.Contains(err.Error(), expect)) {
+			t.Errorf("%q: error should contain %q, but got %v", src, expect, err)
+		}
+	}
+
+	if _, err := NewWithError(WithYAMLKnownFields("schema")); err == nil {
+		t.Error("a non-struct prototype must be an error")
+	}
+}
+
+type testCache map[string]map[string]interface{}
+
+func (c testCache) Get(key string) (map[string]interface{}, bool) {
+	m, ok := c[key]
+	return m, ok
+}
+
+func (c testCache) Set(key string, m map[string]interface{}) {
+	c[key] = m
+}
+
+func TestMeta_Cache(t *testing.T) {
+	decoded := 0
+	decode := func(buf []byte, v interface{}) error {
+		decoded++
+		return json.Unmarshal(buf, v)
+	}
+	cache := testCache{}
+	markdown := goldmark.New(goldmark.WithExtensions(New(
+		WithDecoder('{', decode), WithCache(cache), WithKeyAliases(map[string]string{"title": "Title"}))))
+	source := `<!--{ "title": "mmd" }-->` + "\nMarkdown with metadata\n"
+
+	for i := 1; i <= 2; i++ {
+		context, _ := convert(t, markdown, source)
+		if m := Get(context); m["Title"] != "mmd" {
+			t.Errorf("parse %d: Title must be 'mmd', but got %v", i, m)
+		}
+	}
+	if decoded != 1 {
+		t.Errorf("the block must be decoded once, but was decoded %d times", decoded)
+	}
+	if len(cache) != 1 {
+		t.Errorf("the cache should have 1 entry, but got %d", len(cache))
+	}
+	for _, m := range cache {
+		if _, ok := m["title"]; !ok {
+			t.Errorf("the cache should store metadata before it's processed, but got %v", m)
+		}
+	}
+}
+
+func TestMeta_CacheShared(t *testing.T) {
+	cache := testCache{}
+	plain := goldmark.New(goldmark.WithExtensions(New(WithCache(cache))))
+	strict := goldmark.New(goldmark.WithExtensions(New(WithCache(cache), WithStrictJSON())))
+	source := `<!--{ "Title": "a", "Title": "b" }-->` + "\nMarkdown with metadata\n"
+
+	context, _ := convert(t, plain, source)
+	if _, err := TryGet(context); err != nil {
+		t.Fatalf("the plain parser should accept duplicate keys, but got %v", err)
+	}
+	context, _ = convert(t, strict, source)
+	if _, err := TryGet(context); err == nil {
+		t.Error("the strict parser should reject duplicate keys cached by the plain parser")
+	}
+}
+
+func TestMeta_BuildVars(t *testing.T) {
+	source := `<!--:[env=dev]
+Title: mmd (dev)
+:-->
+
+<!--:[env=prod, region=eu]
+Title: mmd
+:-->
+Markdown with metadata
+`
+	vars := map[string]map[string]string{
+		"mmd (dev)": {"env": "dev"},
+		"mmd":       {"env": "prod", "region": "eu"},
+		"":          {"env": "prod"},
+	}
+
+	for title, v := range vars {
+		markdown := goldmark.New(goldmark.WithExtensions(New(WithBuildVars(v))))
+		context, out := convert(t, markdown, source)
+		if m, err := TryGet(context); err != nil {
+			t.Errorf("%v: %s", v, err)
+		} else if title == "" && m != nil {
+			t.Errorf("%v: no block must be parsed, but got %v", v, m)
+		} else if title != "" && m["Title"] != title {
+			t.Errorf("%v: Title must be %q, but got %v", v, title, m["Title"])
+		}
+		if out != "<p>Markdown with metadata</p>\n" {
+			t.Errorf("%v: skipped blocks should render as nothing, but got %q", v, out)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a, err := Parse([]byte("<!--:\nTitle: mmd\nDraft: true\nAuthor:\n  Name: gearsix\n  Site: example.com\n:-->\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Parse([]byte("<!--{ \"Title\": \"goldmark-mmd\", \"Tags\": [\"markdown\"], \"Author\": { \"Name\": \"gearsix\", \"Mail\": \"x\" } }-->\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := []string{
+		"added Author.Mail: x",
+		"removed Author.Site: example.com",
+		"removed Draft: true",
+		"added Tags: [markdown]",
+		"changed Title: mmd -> goldmark-mmd",
+	}
+	if diff := Diff(a, b); !reflect.DeepEqual(diff, expect) {
+		t.Errorf("must be %q, but got %q", expect, diff)
+	}
+	if diff := Diff(a, a); len(diff) != 0 {
+		t.Errorf("identical metadata should have no differences, but got %q", diff)
+	}
+}
+
+func TestMeta_Banner(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := map[string]bool{
+		"<!-- Copyright (c) gearsix -->\n<!--:\nTitle: mmd\n:-->\nMarkdown with metadata\n":                        true,
+		"<!DOCTYPE html>\n<!--\n  Copyright (c) gearsix\n-->\n\n<!--:\nTitle: mmd\n:-->\nMarkdown with metadata\n": true,
+		"Markdown\n\n<!--:\nTitle: mmd\n:-->\n":                                                                    false,
+		"<!-- Copyright (c) gearsix -->\nMarkdown\n\n<!--:\nTitle: mmd\n:-->\n":                                    false,
+	}
+
+	for src, present := range source {
+		context, _ := convert(t, markdown, src)
+		if m, err := TryGet(context); err != nil {
+			t.Errorf("%q: %s", src, err)
+		} else if (m["Title"] == "mmd") != present {
+			t.Errorf("%q: metadata present must be %v, but got %v", src, present, m)
+		}
+	}
+}
+
+func TestGetFlat(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	if m := GetFlat(parser.NewContext()); m != nil {
+		t.Errorf("should return nil without metadata, but got %v", m)
+	}
+
+	source := "<!--:\nTitle: mmd\nTags: [markdown, goldmark]\nAuthor:\n  Name: gearsix\n  Links: []\n:-->\n"
+	context, _ := convert(t, markdown, source)
+	expect := map[string]interface{}{
+		"Title":        "mmd",
+		"Tags.0":       "markdown",
+		"Tags.1":       "goldmark",
+		"Author.Name":  "gearsix",
+		"Author.Links": []interface{}{},
+	}
+	if m := GetFlat(context); !reflect.DeepEqual(m, expect) {
+		t.Errorf("must be %v, but got %v", expect, m)
+	}
+
+	context, _ = convert(t, markdown, "<!--{ \"\": 1, \"Title\": \"mmd\", \"Tags\": { \"\": [] } }-->\n")
+	expect = map[string]interface{}{"": 1.0, "Title": "mmd", "Tags.": []interface{}{}}
+	if m := GetFlat(context); !reflect.DeepEqual(m, expect) {
+		t.Errorf("empty keys must be %v, but got %v", expect, m)
+	}
+}
+
+func TestMeta_LenientClose(t *testing.T) {
+	source := "<!--:\nTitle: mmd\nTags:\n  - markdown\n---\nMarkdown with metadata\n"
+
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithLenientClose())))
+	context, out := convert(t, markdown, source)
+	if m, err := TryGet(context); err != nil {
+		t.Error(err)
+	} else if m["Title"] != "mmd" {
+		t.Errorf("Title must be 'mmd', but got %v", m["Title"])
+	}
+	if out != "<p>Markdown with metadata</p>\n" {
+		t.Errorf("should render the body, but got %q", out)
+	}
+
+	context, _ = convert(t, goldmark.New(goldmark.WithExtensions(Meta)), source)
+	if _, err := TryGet(context); err == nil {
+		t.Error("'---' shouldn't close the block without WithLenientClose")
+	}
+}
+
+func TestMeta_MaxAliasExpansion(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithMaxAliasExpansion(100))))
+	bomb := "a: &a\n- lol\n- lol\n"
+	for _, name := range []string{"b", "c", "d", "e", "f", "g"} {
+		bomb += name + ": &" + name + "\n" + strings.Repeat("- *"+string(rune(name[0]-1))+"\n", 9)
+	}
+	source := map[string]bool{
+		"a: &a [lol, lol]\nb: &b [*a, *a, *a, *a, *a]\nc: &c [*b, *b, *b, *b, *b]\nd: [*c, *c, *c, *c, *c]\n": false,
+		bomb: false,
+		"base: &base\n  Name: mmd\n  Tags: [\"*a\", '*a']\nx:\n  <<: *base\ny: *base # *base *base\n": true,
+		"Title: mmd\nQuery: a*b & c\n": true,
+	}
+
+	for src, ok := range source {
+		n := aliasExpansion([]byte(src), 100)
+		if ok && n > 100 {
+			t.Errorf("%q: must be allowed, but expands to %d nodes", src, n)
+		} else if !ok && n <= 100 {
+			t.Errorf("%q: must be rejected, but expands to %d nodes", src, n)
+		}
+		if !ok {
+			context, _ := convert(t, markdown, "<!--:\n"+src+":-->\n")
+			if _, err := TryGet(context); err == nil || !strings.Contains(err.Error(), "more than 100 nodes") {
+				t.Errorf("%q: should report the alias expansion, but got %v", src, err)
+			}
+		}
+	}
+	if n := aliasExpansion([]byte("base: &base\n  Name: mmd\nx: *base\ny: *base\n"), 100); n != 6 {
+		t.Errorf("two aliases of a 3 node mapping should expand to 6 nodes, but got %d", n)
+	}
+}
+
+func TestMeta_OnParsed(t *testing.T) {
+	var parsed []metadata
+	onParsed := func(m metadata) {
+		parsed = append(parsed, m)
+	}
+	markdown := goldmark.New(goldmark.WithExtensions(New(
+		WithOnParsed(onParsed), WithKeyAliases(map[string]string{"title": "Title"}))))
+
+	convert(t, markdown, invalidSource["yaml"])
+	if len(parsed) != 0 {
+		t.Errorf("must not be called for invalid metadata, but got %v", parsed)
+	}
+
+	convert(t, markdown, "<!--{ \"title\": \"mmd\" }-->\nMarkdown with metadata\n")
+	expect := []metadata{{"Title": "mmd"}}
+	if !reflect.DeepEqual(parsed, expect) {
+		t.Errorf("must be called once with %v, but got %v", expect, parsed)
+	}
+}
+
+func TestMeta_LenientJSON(t *testing.T) {
+	source := `<!--{
+	// the title
+	"Title": "mmd // not a comment",
+	"Tags": [ "markdown", "goldmark", ], /* trailing, */
+	"Summary": "a, }",
+}-->
+Markdown with metadata
+`
+
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithLenientJSON())))
+	context, _ := convert(t, markdown, source)
+	expect := metadata{
+		"Title":   "mmd // not a comment",
+		"Tags":    []interface{}{"markdown", "goldmark"},
+		"Summary": "a, }",
+	}
+	if m, err := TryGet(context); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(m, expect) {
+		t.Errorf("must be %v, but got %v", expect, m)
+	}
+
+	context, _ = convert(t, goldmark.New(goldmark.WithExtensions(Meta)), source)
+	if _, err := TryGet(context); err == nil {
+		t.Error("JSON must be strict without WithLenientJSON")
+	}
+}
+
+func TestGetAny(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	keys := []string{"summary", "description", "excerpt"}
+	source := map[string]interface{}{
+		"<!--:\nexcerpt: c\ndescription: b\nsummary: a\n:-->\n": "a",
+		"<!--:\nexcerpt: c\ndescription: b\n:-->\n":             "b",
+		"<!--:\nexcerpt: c\n:-->\n":                             "c",
+		"<!--:\nTitle: mmd\n:-->\n":                             nil,
+	}
+
+	for src, expect := range source {
+		context, _ := convert(t, markdown, src)
+		if v, ok := GetAny(context, keys...); v != expect || ok != (expect != nil) {
+			t.Errorf("%q: must be %v, but got %v (%v)", src, expect, v, ok)
+		}
+	}
+}
+
+func TestGetAs(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+
+	for _, format := range testMetaFormats {
+		if _, ok := GetAs[string](parser.NewContext(), "Title"); ok {
+			t.Errorf("%s: Title must be missing without metadata", format)
+		}
+		context, _ := convert(t, markdown, validSource[format])
+		if title, ok := GetAs[string](context, "Title"); !ok || title != "mmd" {
+			t.Errorf("%s: Title must be 'mmd', but got %q (%v)", format, title, ok)
+		}
+		if tags, ok := GetAs[[]interface{}](context, "Tags"); !ok || len(tags) != 2 || tags[0] != "markdown" {
+			t.Errorf("%s: Tags must be [markdown goldmark], but got %v (%v)", format, tags, ok)
+		}
+		if tags, ok := GetAs[string](context, "Tags"); ok || tags != "" {
+			t.Errorf("%s: Tags isn't a string, but got %q (%v)", format, tags, ok)
+		}
+		if _, ok := GetAs[string](context, "Missing"); ok {
+			t.Errorf("%s: Missing must not be found", format)
+		}
+	}
+}
+
+func TestKeySpans(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithKeySpans())))
+	source := validSource["yaml"]
+	context, _ := convert(t, markdown, source)
+
+	spans := KeySpans(context)
+	expect := map[string]string{
+		"Title":   "Title: mmd",
+		"Summary": "Summary: Add YAML metadata to the document",
+		"Tags":    "Tags:\n  - markdown\n  - goldmark",
+	}
+	if len(spans) != len(expect) {
+		t.Errorf("should have %d spans, but got %v", len(expect), spans)
+	}
+	for key, text := range expect {
+		if span, ok := spans[key]; !ok || source[span[0]:span[1]] != text {
+			t.Errorf("%s: span must be %q, but got %v", key, text, span)
+		}
+	}
+
+	context, _ = convert(t, markdown, validSource["json"])
+	if spans := KeySpans(context); spans != nil {
+		t.Errorf("JSON metadata shouldn't have spans, but got %v", spans)
+	}
+}
+
+func TestGetOrdered(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithYAMLMapSlice())))
+	source := "<!--:\nzeta: 1\nTitle: mmd\nalpha:\n  b: 2\n  a: 1\nMiddle: [x]\n:-->\n"
+	context, _ := convert(t, markdown, source)
+
+	var keys []string
+	for _, kv := range GetOrdered(context) {
+		keys = append(keys, kv.Key)
+	}
+	if expect := []string{"zeta", "Title", "alpha", "Middle"}; !reflect.DeepEqual(keys, expect) {
+		t.Errorf("keys must be in source order %v, but got %v", expect, keys)
+	}
+
+	source = "<!--:\nzeta: 1\nalpha:\n  b: 2\n  a:\n    q: [1, 2]\n    p: 1\nlist:\n- d: 1\n  c: 2\n:-->\n"
+	context, _ = convert(t, markdown, source)
+	out, err := yaml.Marshal(GetOrdered(context))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expect := "zeta: 1\nalpha:\n    b: 2\n    a:\n        q:\n            - 1\n            - 2\n        p: 1\nlist:\n    - d: 1\n      c: 2\n"; string(out) != expect {
+		t.Errorf("nested keys must be in source order:\n%s\ngot:\n%s", expect, out)
+	}
+
+	context, _ = convert(t, markdown, validSource["json"])
+	if kvs := GetOrdered(context); kvs != nil {
+		t.Errorf("JSON metadata must not be ordered without WithOrderedKeys, but got %v", kvs)
+	}
+}
+
+func TestMeta_MandatoryBlock(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithMandatoryBlock())))
+	source := map[string]bool{
+		"Markdown without metadata\n": false,
+		"<!--:\n:-->\nMarkdown\n":     true,
+		validSource["yaml"]:           true,
+	}
+
+	for src, ok := range source {
+		context, _ := convert(t, markdown, src)
+		_, err := TryGet(context)
+		if ok && err != nil {
+			t.Errorf("%q: should parse, but got %v", src, err)
+		} else if !ok && !errors.Is(err, ErrNoMetadata) {
+			t.Errorf("%q: should return ErrNoMetadata, but got %v", src, err)
+		}
+		if Present(context) != ok {
+			t.Errorf("%q: Present must be %v", src, ok)
+		}
+	}
+}
+
+func TestMeta_DeriveSlug(t *testing.T) {
+	source := map[string]string{
+		"<!--:\nTitle: \"Hello World\"\n:-->\n":               "hello-world",
+		"<!--:\ntitle: \"  Héllo, World! (2nd ed.)\"\n:-->\n": "héllo-world-2nd-ed",
+		"<!--:\nTitle: Hello World\nslug: hi\n:-->\n":         "",
+		"<!--:\nSummary: no title\n:-->\n":                    "",
+	}
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithDeriveSlug(nil))))
+	for src, slug := range source {
+		context, _ := convert(t, markdown, src)
+		if v, ok := Get(context)["Slug"]; (slug == "" && ok) || (slug != "" && v != slug) {
+			t.Errorf("%q: Slug must be %q, but got %v", src, slug, v)
+		}
+	}
+
+	derive := func(m metadata) string {
+		return fmt.Sprintf("%v-%v", m["Date"], slugify(m))
+	}
+	markdown = goldmark.New(goldmark.WithExtensions(New(WithDeriveSlug(derive))))
+	context, _ := convert(t, markdown, "<!--:\nTitle: Hello World\nDate: 2023\n:-->\n")
+	if v := Get(context)["Slug"]; v != "2023-hello-world" {
+		t.Errorf("Slug must be derived by the function, but got %v", v)
+	}
+}
+
+func TestMeta_OnlyBlock(t *testing.T) {
+	source := map[string][]string{
+		"yaml": {"<!--: Title: mmd :-->", "<!--:\nTitle: mmd\n:-->", "<!--:\r\nTitle: mmd\r\n:-->\r\n", "<!--:\nTitle: mmd\n:-->\n\n"},
+		"json": {"<!--{ \"Title\": \"mmd\" }-->", "<!--{\n\"Title\": \"mmd\"\n}-->", "<!--{\n\"Title\": \"mmd\"\n}-->\n"},
+		"toml": {"<!--# Title = \"mmd\" #-->", "<!--#\nTitle = \"mmd\"\n#-->", "<!--#\nTitle = \"mmd\"\n#-->\n"},
+	}
+
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	for _, format := range testMetaFormats {
+		for _, src := range source[format] {
+			context, out := convert(t, markdown, src)
+			if m, err := TryGet(context); err != nil || m["Title"] != "mmd" {
+				t.Errorf("%s: %q: Title must be 'mmd', but got %v (%v)", format, src, m, err)
+			}
+			if out != "" {
+				t.Errorf("%s: %q: output must be empty, but got %q", format, src, out)
+			}
+			if _, body, err := ExtractMeta([]byte(src)); err != nil || len(bytes.TrimSpace(body)) != 0 {
+				t.Errorf("%s: %q: body must be empty, but got %q (%v)", format, src, body, err)
+			}
+		}
+	}
+}
+
+func TestMeta_Enum(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(
+		WithEnum("status", "draft", "review", "published"),
+		WithEnum("lang", "en", "fr"),
+	)))
+	source := map[string]string{
+		"<!--:\nstatus: review\nlang: en\n:-->\n":   "",
+		"<!--:\nTitle: mmd\n:-->\n":                 "",
+		"<!--:\nstatus: archived\nlang: en\n:-->\n": `meta: status: "archived" is not one of draft, review, published`,
+		"<!--:\nstatus: draft\nlang: de\n:-->\n":    `meta: lang: "de" is not one of en, fr`,
+		"<!--:\nstatus: 1\n:-->\n":                  `meta: status: 1 is not one of draft, review, published`,
+	}
+
+	for src, expected := range source {
+		context, _ := convert(t, markdown, src)
+		_, err := TryGet(context)
+		if expected == "" && err != nil {
+			t.Errorf("%q: must not be an error, but got %v", src, err)
+		} else if expected != "" && (err == nil || err.Error() != expected) {
+			t.Errorf("%q: should return %q, but got %v", src, expected, err)
+		}
+	}
+}
+
+func TestMeta_PrettyJSON(t *testing.T) {
+	source := map[string]string{
+		"<!--{\n  \"Title\": \"mmd\",\n  \"Author\": {\n    \"Name\": \"gearsix\"\n  },\n  \"Tags\": [\n    \"markdown\"\n  ]\n}\n-->\nMarkdown with metadata\n": "nested",
+		"<!--{\r\n  \"Title\": \"mmd\"\r\n}\r\n-->\r\nMarkdown with metadata\r\n":                                                                                "crlf",
+		"<!--{\n  \"Title\": \"mmd\"\n}  \n\n  -->\nMarkdown with metadata\n":                                                                                    "spaced",
+	}
+
+	for _, opts := range [][]Option{nil, {WithFormats("json")}} {
+		markdown := goldmark.New(goldmark.WithExtensions(New(opts...)))
+		for src, name := range source {
+			context, out := convert(t, markdown, src)
+			m, err := TryGet(context)
+			if err != nil || m["Title"] != "mmd" {
+				t.Errorf("%s: Title must be 'mmd', but got %v (%v)", name, m, err)
+			}
+			if out != "<p>Markdown with metadata</p>\n" {
+				t.Errorf("%s: only the body must be rendered, but got %q", name, out)
+			}
+		}
+	}
+}
+
+func TestMeta_TextAfterClose(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	source := map[string]string{
+		"<!--{ \"Title\": \"mmd\" }--> Some text\nMore text\n": "<p>Some text\nMore text</p>\n",
+		"<!--{ \"Title\": \"mmd\" }-->Some text\n":             "<p>Some text</p>\n",
+		"<!--{\n\"Title\": \"mmd\"\n}\n--> Some text\n":        "<p>Some text</p>\n",
+		"<!--:\nTitle: mmd\n:--> Some text\n":                  "<p>Some text</p>\n",
+		"<!--# Title = \"mmd\" #--> Some *text*\n":             "<p>Some <em>text</em></p>\n",
+		"<!--:\nTitle: mmd\n:--> # Heading\n":                  "<h1>Heading</h1>\n",
+	}
+
+	for src, expect := range source {
+		context, out := convert(t, markdown, src)
+		if m, err := TryGet(context); err != nil || m["Title"] != "mmd" {
+			t.Errorf("%q: Title must be 'mmd', but got %v (%v)", src, m, err)
+		}
+		if out != expect {
+			t.Errorf("%q: should render %q, but got %q", src, expect, out)
+		}
+		if _, body, _ := ExtractMeta([]byte(src)); !strings.Contains(string(body), "Some") && !strings.Contains(string(body), "Heading") {
+			t.Errorf("%q: the body should keep the text after the close token, but got %q", src, body)
+		}
+	}
+}
+
+func TestMeta_Environment(t *testing.T) {
+	source := `<!--:
+Title: mmd
+BaseURL: http://localhost
+Params:
+  Analytics: false
+  Theme: light
+production:
+  BaseURL: https://example.com
+  Params:
+    Analytics: true
+staging:
+  BaseURL: https://staging.example.com
+:-->
+`
+	expect := map[string]interface{}{
+		"Title":   "mmd",
+		"BaseURL": "https://example.com",
+		"Params":  map[string]interface{}{"Analytics": true, "Theme": "light"},
+	}
+
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithEnvironment("production", "staging"))))
+	context, _ := convert(t, markdown, source)
+	if m := normalize(Get(context)); !reflect.DeepEqual(m, expect) {
+		t.Errorf("must be %v, but got %v", expect, m)
+	}
+
+	markdown = goldmark.New(goldmark.WithExtensions(New(WithEnvironment("development", "production", "staging"))))
+	context, _ = convert(t, markdown, source)
+	if m := Get(context); m["BaseURL"] != "http://localhost" || len(m) != 3 {
+		t.Errorf("should only remove the environments without a submap to merge, but got %v", m)
+	}
+}
+
+func TestMeta_KeyStyle(t *testing.T) {
+	source := "<!--:\npublishDate: today\nLast_Modified: yesterday\nHTMLTitle: mmd\nauthor-name: gearsix\n:-->\nMarkdown with metadata"
+	expected := map[string]map[string]string{
+		"snake": {"publish_date": "today", "last_modified": "yesterday", "html_title": "mmd", "author_name": "gearsix"},
+		"camel": {"publishDate": "today", "lastModified": "yesterday", "htmlTitle": "mmd", "authorName": "gearsix"},
+		"kebab": {"publish-date": "today", "last-modified": "yesterday", "html-title": "mmd", "author-name": "gearsix"},
+	}
+
+	for style, keys := range expected {
+		markdown := goldmark.New(goldmark.WithExtensions(New(WithKeyStyle(style))))
+		context, _ := convert(t, markdown, source)
+		m, err := TryGet(context)
+		if err != nil {
+			t.Fatalf("%s: %s", style, err)
+		}
+		if len(m) != len(keys) {
+			t.Errorf("%s: should have %d keys, but got %v", style, len(keys), m)
+		}
+		for k, v := range keys {
+			if fmt.Sprint(m[k]) != v {
+				t.Errorf("%s: %s must be %q, but got %#v", style, k, v, m[k])
+			}
+		}
+	}
+
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithKeyStyle("snake"))))
+	context, _ := convert(t, markdown, "<!--:\npublishDate: a\npublish_date: b\n:-->\n")
+	if _, err := TryGet(context); err == nil || !strings.Contains(err.Error(), "publish_date") {
+		t.Errorf("colliding keys should return an error, but got %v", err)
+	}
+
+	if _, err := NewWithError(WithKeyStyle("pascal")); err == nil {
+		t.Error("an unknown key style should error")
+	}
+	markdown = goldmark.New(goldmark.WithExtensions(New(WithKeyStyle("pascal"))))
+	context, _ = convert(t, markdown, source)
+	if _, err := TryGet(context); err == nil || !strings.Contains(err.Error(), "pascal") {
+		t.Errorf("an unknown key style should return a parsing error, but got %v", err)
+	}
+
+	markdown = goldmark.New(goldmark.WithExtensions(New(WithKeyStyle("camel"))))
+	context, _ = convert(t, markdown, "<!--:\npublish_über: a\n:-->\n")
+	if m := Get(context); m["publishÜber"] != "a" {
+		t.Errorf("multi-byte words must be capitalized, but got %v", m)
+	}
+}
+
+func TestMeta_EscapedClose(t *testing.T) {
+	source := map[string]string{
+		"yaml": "<!--:\nTitle: mmd\nSnippet: \"<!-- note :--\\> -->\"\nAuthor: gearsix\n:-->\nMarkdown with metadata",
+		"json": "<!--{\n\"Title\": \"mmd\",\n\"Snippet\": \"<!-- note }--\\> -->\",\n\"Author\": \"gearsix\"\n}-->\nMarkdown with metadata",
+		"toml": "<!--#\nTitle = \"mmd\"\nSnippet = \"<!-- note #--\\> -->\"\nAuthor = \"gearsix\"\n#-->\nMarkdown with metadata",
+	}
+	snippet := map[string]string{
+		"yaml": "<!-- note :--> -->",
+		"json": "<!-- note }--> -->",
+		"toml": "<!-- note #--> -->",
+	}
+
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	for _, format := range testMetaFormats {
+		context, out := convert(t, markdown, source[format])
+		m, err := TryGet(context)
+		if err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		if m["Snippet"] != snippet[format] {
+			t.Errorf("%s: Snippet must be %q, but got %#v", format, snippet[format], m["Snippet"])
+		}
+		if m["Author"] != "gearsix" {
+			t.Errorf("%s: the whole block must be captured, but got %v", format, m)
+		}
+		if out != "<p>Markdown with metadata</p>\n" {
+			t.Errorf("%s: the block must not be rendered, but got %q", format, out)
+		}
+	}
+}
+
+// baseURLRenderer renders links with the "baseurl" metadata before their
+// destination.
+type baseURLRenderer struct{}
+
+func (r baseURLRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(gast.KindLink, func(w util.BufWriter, source []byte, n gast.Node, entering bool) (gast.WalkStatus, error) {
+		if entering {
+			base, _ := GetFromRenderer(n)["baseurl"].(string)
+			fmt.Fprintf(w, "<a href=\"%s%s\">", base, n.(*gast.Link).Destination)
+		} else {
+			w.WriteString("</a>")
+		}
+		return gast.WalkContinue, nil
+	})
+}
+
+func TestGetFromRenderer(t *testing.T) {
+	markdown := goldmark.New(
+		goldmark.WithExtensions(Meta),
+		goldmark.WithRendererOptions(renderer.WithNodeRenderers(util.Prioritized(baseURLRenderer{}, 100))),
+	)
+	source := "<!--:\nbaseurl: https://example.com\n:-->\n[post](/post)\n"
+
+	_, out := convert(t, markdown, source)
+	if expected := "<p><a href=\"https://example.com/post\">post</a></p>\n"; out != expected {
+		t.Errorf("should render %q, but got %q", expected, out)
+	}
+
+	_, out = convert(t, markdown, "[post](/post)\n")
+	if expected := "<p><a href=\"/post\">post</a></p>\n"; out != expected {
+		t.Errorf("should render %q without metadata, but got %q", expected, out)
+	}
+	if m := GetFromRenderer(gast.NewParagraph()); m != nil {
+		t.Errorf("a node without a document should have no metadata, but got %v", m)
+	}
+}
+
+func TestMeta_RejectEmpty(t *testing.T) {
+	source := map[string]bool{
+		"<!--:\n:-->\nMarkdown\n":             true,
+		"<!--: :-->\nMarkdown\n":              true,
+		"<!--{}-->\nMarkdown\n":               true,
+		"<!--:\nTitle: mmd\n:-->\nMarkdown\n": false,
+		"Markdown\n":                          false,
+	}
+
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithRejectEmpty())))
+	for src, empty := range source {
+		context, _ := convert(t, markdown, src)
+		_, err := TryGet(context)
+		if empty && !errors.Is(err, ErrEmptyMetadata) {
+			t.Errorf("%q: should return ErrEmptyMetadata, but got %v", src, err)
+		} else if !empty && err != nil {
+			t.Errorf("%q: must not be an error, but got %v", src, err)
+		}
+	}
+}
+
+func TestMeta_ReportUnknownSignal(t *testing.T) {
+	source := map[string]bool{
+		"<!--@\nTitle: mmd\n@-->\nMarkdown\n": true,
+		"<!--; Title = mmd ;-->\nMarkdown\n":  true,
+		"<!-- a comment -->\nMarkdown\n":      false,
+		"<!---->\nMarkdown\n":                 false,
+		"Markdown\n\n<!--@ x @-->\n":          false,
+	}
+
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithReportUnknownSignal())))
+	for src, unknown := range source {
+		context, _ := convert(t, markdown, src)
+		_, err := TryGet(context)
+		if unknown && !errors.Is(err, ErrUnknownSignal) {
+			t.Errorf("%q: should return ErrUnknownSignal, but got %v", src, err)
+		} else if !unknown && err != nil {
+			t.Errorf("%q: must not be an error, but got %v", src, err)
+		}
+	}
+
+	context, _ := convert(t, goldmark.New(goldmark.WithExtensions(Meta)), "<!--@\nTitle: mmd\n@-->\n")
+	if _, err := TryGet(context); err != nil {
+		t.Errorf("unknown signals must be ignored by default, but got %v", err)
+	}
+}
+
+func TestGetCSVSlice(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(Meta))
+	expect := []string{"markdown", "goldmark"}
+	source := map[string][]string{
+		"<!--:\nTags: [markdown, goldmark]\n:-->\n":      expect,
+		"<!--:\nTags: markdown, goldmark\n:-->\n":        expect,
+		"<!--:\nTags: \" markdown,,goldmark ,\"\n:-->\n": expect,
+		"<!--:\nTags: markdown\n:-->\n":                  {"markdown"},
+		"<!--:\nTags: [1, 2]\n:-->\n":                    nil,
+		"<!--:\nTitle: mmd\n:-->\n":                      nil,
+	}
+
+	for src, expect := range source {
+		context, _ := convert(t, markdown, src)
+		if s, ok := GetCSVSlice(context, "Tags"); !reflect.DeepEqual(s, expect) || ok != (expect != nil) {
+			t.Errorf("%q: must be %q, but got %q (%v)", src, expect, s, ok)
+		}
+	}
+}
+
+func TestMeta_Placeholder(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithPlaceholder("<!--META-->"), WithTrailingBlock())))
+	source := map[string]string{
+		validSource["yaml"]: "<!--META-->\n<p>Markdown with metadata</p>\n",
+		"Markdown with metadata\n\n<!--{ \"Title\": \"mmd\" }-->\n": "<p>Markdown with metadata</p>\n<!--META-->",
+	}
+
+	for src, expect := range source {
+		context, out := convert(t, markdown, src)
+		if out != expect {
+			t.Errorf("%q: should render %q, but got %q", src, expect, out)
+		}
+		if title := Get(context)["Title"]; title != "mmd" {
+			t.Errorf("%q: Title must be 'mmd', but got %v", src, title)
+		}
+	}
+}
+
+func TestMeta_MultipleBlocks(t *testing.T) {
+	source := `<!--:
+Title: mmd
+Tags: [markdown]
+Author:
+  Name: gearsix
+:-->
+
+<!--{ "Summary": "Add metadata to the document", "Tags": ["goldmark"] }-->
+<!--# Draft = true #-->
+Markdown with metadata
+
+<!--: Ignored: true :-->
+`
+	expect := map[string]interface{}{
+		"Title":   "mmd",
+		"Summary": "Add metadata to the document",
+		"Tags":    []interface{}{"goldmark"},
+		"Author":  map[string]interface{}{"Name": "gearsix"},
+		"Draft":   true,
+	}
+
+	markdown := goldmark.New(goldmark.WithExtensions(New(WithMultipleBlocks(), WithOrderedKeys())))
+	context, out := convert(t, markdown, source)
+	if m, err := TryGet(context); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(normalize(m), expect) {
+		t.Errorf("must be %v, but got %v", expect, m)
+	}
+	if keys := OrderedKeys(context); !reflect.DeepEqual(keys, []string{"Title", "Tags", "Author", "Summary", "Draft"}) {
+		t.Errorf("keys must be in source order, but got %v", keys)
+	}
+	if !strings.HasPrefix(out, "<p>Markdown with metadata</p>\n") {
+		t.Errorf("the blocks must not be rendered, but got %q", out)
+	}
+
+	context, _ = convert(t, goldmark.New(goldmark.WithExtensions(Meta)), source)
+	if m := Get(context); len(m) != 3 {
+		t.Errorf("only the first block must be parsed by default, but got %v", m)
+	}
+}
+
+func TestNewParser(t *testing.T) {
+	markdown := goldmark.New(goldmark.WithParserOptions(
+		parser.WithBlockParsers(util.Prioritized(NewParser(WithNamedFormats(), WithStoresInDocument()), 0)),
+	))
+	source := "<!--yaml\nTitle: mmd\n-->\nMarkdown with metadata\n"
+	context, out := convert(t, markdown, source)
+	if m, err := TryGet(context); err != nil || m["Title"] != "mmd" {
+		t.Errorf("Title must be 'mmd', but got %v (%v)", m, err)
+	}
+	if out != "<p>Markdown with metadata</p>\n" {
+		t.Errorf("should only render the body, but got %q", out)
+	}
+	if NewParser() != NewParser() {
+		t.Error("NewParser without options should return the default parser")
+	}
+}
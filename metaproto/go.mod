@@ -0,0 +1,9 @@
+module github.com/gearsix/goldmark-mmd/metaproto
+
+go 1.18
+
+require (
+	github.com/gearsix/goldmark-mmd v0.0.0-00010101000000-000000000000
+	github.com/yuin/goldmark v1.4.6
+	google.golang.org/protobuf v1.28.1
+)
@@ -0,0 +1,27 @@
+// package metaproto unmarshals the metadata parsed by goldmark-mmd into
+// protocol buffer messages.
+//
+// It's a separate module so that goldmark-mmd doesn't depend on
+// google.golang.org/protobuf.
+package metaproto
+
+import (
+	meta "github.com/gearsix/goldmark-mmd"
+	"github.com/yuin/goldmark/parser"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// UnmarshalInto sets the fields of `msg` from the metadata, decoded from
+// its JSON encoding (see meta.MarshalJSON) with protojson. Keys are matched
+// to fields by their JSON or proto name, and keys without a field are
+// ignored.
+// If there are parsing errors, then the error is returned; if there is no
+// metadata, then meta.ErrNoMetadata is returned.
+func UnmarshalInto(pc parser.Context, msg proto.Message) error {
+	buf, err := meta.MarshalJSON(pc)
+	if err != nil {
+		return err
+	}
+	return protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(buf, msg)
+}
@@ -0,0 +1,79 @@
+package metaproto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	meta "github.com/gearsix/goldmark-mmd"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/parser"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/typepb"
+)
+
+func convert(t *testing.T, src string) parser.Context {
+	t.Helper()
+	markdown := goldmark.New(goldmark.WithExtensions(meta.Meta))
+	context := parser.NewContext()
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(src), &buf, parser.WithContext(context)); err != nil {
+		t.Fatal(err)
+	}
+	return context
+}
+
+func TestUnmarshalInto(t *testing.T) {
+	context := convert(t, `<!--{
+  "name": "mmd",
+  "fields": [
+    { "name": "title", "kind": "TYPE_STRING", "number": 1 },
+    { "name": "weight", "kind": "TYPE_INT32", "number": 2 }
+  ],
+  "source_context": { "fileName": "page.md" },
+  "syntax": "SYNTAX_PROTO3",
+  "draft": true
+}-->
+Markdown with metadata`)
+
+	var typ typepb.Type
+	if err := UnmarshalInto(context, &typ); err != nil {
+		t.Fatal(err)
+	}
+	if typ.Name != "mmd" || typ.Syntax != typepb.Syntax_SYNTAX_PROTO3 {
+		t.Errorf("scalar and enum fields should be set, got %v", &typ)
+	}
+	if len(typ.Fields) != 2 || typ.Fields[0].Kind != typepb.Field_TYPE_STRING ||
+		typ.Fields[1].Kind != typepb.Field_TYPE_INT32 || typ.Fields[1].Number != 2 {
+		t.Errorf("repeated message fields should be set, got %v", typ.Fields)
+	}
+	if typ.SourceContext.GetFileName() != "page.md" {
+		t.Errorf("message fields should be set, got %v", typ.SourceContext)
+	}
+
+	if err := UnmarshalInto(convert(t, `<!--{ "syntax": "SYNTAX_PROTO4" }-->`), &typ); err == nil {
+		t.Error("an unknown enum value should return an error")
+	}
+	if err := UnmarshalInto(parser.NewContext(), &typ); !errors.Is(err, meta.ErrNoMetadata) {
+		t.Errorf("should return ErrNoMetadata, got %v", err)
+	}
+}
+
+func TestUnmarshalInto_WellKnownTypes(t *testing.T) {
+	context := convert(t, "<!--:\nTitle: mmd\nWeight: 3\nTags: [a, b]\nAuthor:\n  Name: gearsix\n:-->\n")
+
+	var s structpb.Struct
+	if err := UnmarshalInto(context, &s); err != nil {
+		t.Fatal(err)
+	}
+	m := s.AsMap()
+	if m["Title"] != "mmd" || m["Weight"] != 3.0 {
+		t.Errorf("scalar values should be set, got %v", m)
+	}
+	if tags, ok := m["Tags"].([]interface{}); !ok || len(tags) != 2 {
+		t.Errorf("list values should be set, got %v", m["Tags"])
+	}
+	if author, ok := m["Author"].(map[string]interface{}); !ok || author["Name"] != "gearsix" {
+		t.Errorf("struct values should be set, got %v", m["Author"])
+	}
+}